@@ -3,9 +3,11 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/charlievieth/num"
 	"github.com/spf13/pflag"
@@ -14,6 +16,16 @@ import (
 var (
 	InputFile  string
 	OutputFile string
+	Regroup    bool
+	Quotes     string
+	Markers    num.Markers
+
+	LineBuffered bool
+	IdleFlush    time.Duration
+	PrintStats   bool
+	Jobs         int
+
+	stats num.Stats // totals printed with '--stats'
 )
 
 func init() {
@@ -22,6 +34,25 @@ func init() {
 		"read input from FILE instead of standard input")
 	pflag.StringVarP(&OutputFile, "output", "o", "",
 		"write result to FILE instead of standard output")
+	pflag.BoolVar(&Regroup, "regroup", false,
+		"also regroup numbers grouped in the Indian style, such as 12,34,567")
+	pflag.StringVar(&Quotes, "quotes", "none",
+		"handling of numbers in quoted strings: none, skip or format")
+	pflag.StringVar(&Markers.Off, "off-marker", "",
+		"pause formatting after STRING (requires '--on-marker')")
+	pflag.StringVar(&Markers.On, "on-marker", "",
+		"resume formatting after STRING (requires '--off-marker')")
+	pflag.BoolVar(&Markers.Strip, "strip-markers", false,
+		"remove the on and off markers from the output")
+	pflag.BoolVar(&LineBuffered, "line-buffered", false,
+		"write each line as soon as it is read, for use with 'tail -f'")
+	pflag.IntVarP(&Jobs, "jobs", "j", 1,
+		"format input on N goroutines, 0 uses all CPUs (ignored with '--line-buffered')")
+	pflag.BoolVar(&PrintStats, "stats", false,
+		"print formatting statistics to standard error")
+	pflag.DurationVar(&IdleFlush, "idle-flush", 100*time.Millisecond,
+		"with '--line-buffered', write a pending number after the input is idle\n"+
+			"for DURATION (0 disables)")
 }
 
 func Usage() {
@@ -49,12 +80,60 @@ func Usage() {
 	fmt.Fprintf(os.Stdout, example, filepath.Base(os.Args[0]))
 }
 
+var quoteModes = map[string]num.QuoteMode{
+	"none":   num.QuoteNone,
+	"skip":   num.QuoteSkip,
+	"format": num.QuoteFormat,
+}
+
+func options() num.Options {
+	return num.Options{
+		Regroup: Regroup,
+		Quotes:  quoteModes[Quotes],
+		Markers: Markers,
+	}
+}
+
+func newEncoder(w io.Writer) *num.Encoder {
+	enc := num.NewEncoder(w)
+	enc.SetOptions(options())
+	if LineBuffered {
+		enc.SetLineBuffered(true)
+		enc.SetIdleFlush(IdleFlush)
+	}
+	return enc
+}
+
+func printStats(w io.Writer) {
+	rows := []struct {
+		name string
+		n    int64
+	}{
+		{"bytes in", stats.BytesIn},
+		{"bytes out", stats.BytesOut},
+		{"numbers", stats.Numbers},
+		{"grouped", stats.Grouped},
+		{"replaced", stats.Replaced},
+		{"skipped identifiers", stats.SkippedIdent},
+		{"skipped grouped", stats.SkippedGrouped},
+		{"skipped too long", stats.SkippedLong},
+		{"longest number", int64(stats.MaxLen)},
+		{"carry-overs", stats.Carries},
+	}
+	for _, r := range rows {
+		fmt.Fprintf(w, "%-20s %15s\n", r.name+":", num.FormatInt(r.n))
+	}
+}
+
 func formatText(out *os.File, args []string) error {
 	var buf bytes.Buffer
 	for _, s := range args {
 		buf.Reset()
 		r := strings.NewReader(s)
-		if err := num.NewEncoder(&buf).Encode(r); err != nil {
+		enc := newEncoder(&buf)
+		err := enc.Encode(r)
+		stats.Add(enc.Stats())
+		if err != nil {
 			return err
 		}
 		buf.WriteByte('\n')
@@ -86,12 +165,26 @@ func realMain() error {
 		in = f
 	}
 
+	if PrintStats {
+		defer printStats(os.Stderr)
+	}
+
 	if pflag.NArg() != 0 {
 		return formatText(out, pflag.Args())
 	}
 
 	// stream
-	return num.NewEncoder(out).Encode(in)
+	if Jobs != 1 && !LineBuffered {
+		enc := num.NewParallelEncoder(out, Jobs)
+		enc.SetOptions(options())
+		err := enc.Encode(in)
+		stats.Add(enc.Stats())
+		return err
+	}
+	enc := newEncoder(out)
+	err := enc.Encode(in)
+	stats.Add(enc.Stats())
+	return err
 }
 
 func main() {
@@ -103,6 +196,18 @@ func main() {
 		os.Exit(1)
 	}
 
+	if _, ok := quoteModes[Quotes]; !ok {
+		fmt.Fprintf(os.Stderr, "error: invalid '--quotes' mode: %q\n", Quotes)
+		pflag.Usage()
+		os.Exit(1)
+	}
+
+	if (Markers.Off == "") != (Markers.On == "") {
+		fmt.Fprintln(os.Stderr, "error: '--off-marker' and '--on-marker' must both be specified")
+		pflag.Usage()
+		os.Exit(1)
+	}
+
 	if err := realMain(); err != nil {
 		fmt.Fprintln(os.Stderr, "error:", err)
 		os.Exit(1)
@@ -0,0 +1,177 @@
+package num
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// FileOptions are the options used by FormatFile.
+type FileOptions struct {
+	Options
+
+	// Backup, if not empty, is appended to the path of the file to keep a
+	// copy of the original, for example ".orig".  It is only written if the
+	// file changes.
+	Backup string
+}
+
+// FormatFile, formats the numbers in the file at path in place and reports
+// if it changed.  The result is written to a temporary file in the same
+// directory which is synced and renamed over the original, so readers see
+// either the old or the new contents.  The mode of the file is preserved
+// and, where permitted, its owner and group.  If path is a symbolic link
+// the file it refers to is formatted.
+//
+// If formatting would not change the file it is left untouched: no
+// temporary file or backup is created and its modification time is kept.
+func FormatFile(path string, opts FileOptions) (bool, error) {
+	path, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return false, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+	if !fi.Mode().IsRegular() {
+		return false, &os.PathError{Op: "format", Path: path, Err: errors.New("not a regular file")}
+	}
+
+	w := &fileWriter{orig: f, path: path}
+	enc := NewEncoder(w)
+	enc.SetOptions(opts.Options)
+	err = enc.Encode(f)
+	if err == nil && w.tmp == nil && w.off != fi.Size() {
+		// the output is a prefix of the original
+		err = w.diverge()
+	}
+	if err == nil && w.tmp != nil {
+		err = w.commit(fi, opts.Backup)
+	}
+	if err != nil {
+		w.abort()
+		return false, err
+	}
+	return w.tmp != nil, nil
+}
+
+// A fileWriter compares the output of FormatFile with the original file and
+// creates the temporary file at the first difference.
+type fileWriter struct {
+	orig    *os.File
+	path    string
+	off     int64    // length of the output that matches orig
+	scratch []byte   // bytes of orig compared with the output
+	tmp     *os.File // nil while the output matches orig
+}
+
+func (w *fileWriter) Write(p []byte) (int, error) {
+	if w.tmp == nil {
+		if cap(w.scratch) < len(p) {
+			w.scratch = make([]byte, len(p))
+		}
+		b := w.scratch[:len(p)]
+		n, err := w.orig.ReadAt(b, w.off)
+		if err != nil && err != io.EOF {
+			return 0, err
+		}
+		if n == len(p) && bytes.Equal(b, p) {
+			w.off += int64(n)
+			return len(p), nil
+		}
+		if err := w.diverge(); err != nil {
+			return 0, err
+		}
+	}
+	return w.tmp.Write(p)
+}
+
+// diverge, creates the temporary file and copies the matching output to it.
+func (w *fileWriter) diverge() error {
+	tmp, err := os.CreateTemp(filepath.Dir(w.path), "."+filepath.Base(w.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	w.tmp = tmp
+	_, err = io.Copy(tmp, io.NewSectionReader(w.orig, 0, w.off))
+	return err
+}
+
+// commit, replaces the original file with the temporary file, after linking
+// or copying the original to the backup path if set.
+func (w *fileWriter) commit(fi os.FileInfo, backup string) error {
+	tmp := w.tmp
+	// chown clears the setuid and setgid bits, so it must come first
+	chown(tmp, fi) // best effort
+	if err := tmp.Chmod(fi.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if backup != "" {
+		if err := backupFile(w.orig, w.path+backup, fi); err != nil {
+			return err
+		}
+	}
+	w.orig.Close() // Windows cannot replace an open file
+	if err := os.Rename(tmp.Name(), w.path); err != nil {
+		if backup != "" {
+			os.Remove(w.path + backup)
+		}
+		return err
+	}
+	syncDir(filepath.Dir(w.path))
+	return nil
+}
+
+// abort, removes the temporary file, if any.
+func (w *fileWriter) abort() {
+	if w.tmp != nil {
+		w.tmp.Close()
+		os.Remove(w.tmp.Name())
+	}
+}
+
+// backupFile, makes name a hard link to the original file or, if that is
+// not possible, a copy of it.
+func backupFile(orig *os.File, name string, fi os.FileInfo) error {
+	if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if os.Link(orig.Name(), name) == nil {
+		return nil
+	}
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, io.NewSectionReader(orig, 0, fi.Size()))
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// syncDir, syncs the directory so that the rename is durable.  Errors are
+// ignored since not all systems support syncing a directory.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
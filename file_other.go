@@ -0,0 +1,9 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package num
+
+import "os"
+
+// chown, is a no-op on systems without Unix file ownership.
+func chown(f *os.File, fi os.FileInfo) {}
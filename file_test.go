@@ -0,0 +1,148 @@
+package num
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormatFile(t *testing.T) {
+	markers := Options{Markers: Markers{Off: "num:off", On: "num:on", Strip: true}}
+	tests := []struct {
+		in, out string
+		opts    Options
+		changed bool
+	}{
+		{"a 1234567 b\n", "a 1,234,567 b\n", Options{}, true},
+		{"a 1,234,567 b\n", "a 1,234,567 b\n", Options{}, false},
+		{"a 123 b\n", "a 123 b\n", Options{}, false},
+		{"", "", Options{}, false},
+		{"a 1234 num:offnum:on", "a 1,234 ", markers, true},
+		// the output is a prefix of the input
+		{"a 123 num:offnum:on", "a 123 ", markers, true},
+	}
+	for _, x := range tests {
+		dir := t.TempDir()
+		path := filepath.Join(dir, "report.txt")
+		if err := ioutil.WriteFile(path, []byte(x.in), 0640); err != nil {
+			t.Fatal(err)
+		}
+		old := time.Now().Add(-time.Hour).Truncate(time.Second)
+		if err := os.Chtimes(path, old, old); err != nil {
+			t.Fatal(err)
+		}
+		changed, err := FormatFile(path, FileOptions{Options: x.opts, Backup: ".orig"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if changed != x.changed {
+			t.Errorf("%q: changed: got %t want: %t", x.in, changed, x.changed)
+		}
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != x.out {
+			t.Errorf("%q: got %q want: %q", x.in, b, x.out)
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != 0640 {
+			t.Errorf("%q: got mode %v want: %v", x.in, fi.Mode().Perm(), os.FileMode(0640))
+		}
+		if !x.changed && !fi.ModTime().Equal(old) {
+			t.Errorf("%q: unchanged file was modified at %v", x.in, fi.ModTime())
+		}
+		want := []string{"report.txt"}
+		if x.changed {
+			want = []string{"report.txt", "report.txt.orig"}
+			b, err := ioutil.ReadFile(path + ".orig")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != x.in {
+				t.Errorf("%q: backup: got %q want: %q", x.in, b, x.in)
+			}
+		}
+		names, err := filepath.Glob(filepath.Join(dir, "*"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		hidden, _ := filepath.Glob(filepath.Join(dir, ".*"))
+		names = append(names, hidden...)
+		for i := range names {
+			names[i] = filepath.Base(names[i])
+		}
+		sort.Strings(names)
+		if strings.Join(names, " ") != strings.Join(want, " ") {
+			t.Errorf("%q: got files %q want: %q", x.in, names, want)
+		}
+	}
+}
+
+func TestFormatFileSetuid(t *testing.T) {
+	if runtime.GOOS == "windows" || runtime.GOOS == "plan9" {
+		t.Skip("no setuid bits on " + runtime.GOOS)
+	}
+	path := filepath.Join(t.TempDir(), "report.txt")
+	if err := ioutil.WriteFile(path, []byte("1234567"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	mode := 0755 | os.ModeSetuid | os.ModeSetgid
+	if err := os.Chmod(path, mode); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := FormatFile(path, FileOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode() != mode {
+		t.Errorf("got mode %v want: %v", fi.Mode(), mode)
+	}
+}
+
+func TestFormatFileSymlink(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "report.txt")
+	if err := ioutil.WriteFile(path, []byte("1234567"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "link.txt")
+	if err := os.Symlink(path, link); err != nil {
+		t.Skip(err)
+	}
+	if _, err := FormatFile(link, FileOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := os.Lstat(link); err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("link was replaced: %v", err)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "1,234,567" {
+		t.Errorf("got %q want: %q", b, "1,234,567")
+	}
+}
+
+func TestFormatFileError(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := FormatFile(filepath.Join(dir, "missing"), FileOptions{}); !os.IsNotExist(err) {
+		t.Errorf("missing file: got error %v", err)
+	}
+	if _, err := FormatFile(dir, FileOptions{}); err == nil {
+		t.Error("directory: expected an error")
+	}
+
+}
@@ -0,0 +1,17 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package num
+
+import (
+	"os"
+	"syscall"
+)
+
+// chown, sets the owner and group of f to those of fi.  Errors are ignored
+// since only privileged users may give a file away.
+func chown(f *os.File, fi os.FileInfo) {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		f.Chown(int(st.Uid), int(st.Gid))
+	}
+}
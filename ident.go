@@ -0,0 +1,117 @@
+package num
+
+// An IdentKind selects checksum based recognisers that are used to detect
+// numbers that are really identifiers, such as card numbers and ISBNs.
+type IdentKind uint
+
+const (
+	// IdentLuhn matches 12 to 19 digit numbers with a valid Luhn check
+	// digit (credit card and other payment card numbers).
+	IdentLuhn IdentKind = 1 << iota
+
+	// IdentISBN matches 10 digit ISBN-10 numbers and 13 digit ISBN-13
+	// numbers (prefixed with 978 or 979) that have a valid check digit.
+	IdentISBN
+
+	// IdentHex matches short hex hashes that look like an integer followed
+	// by a unit made only of hex letters, such as "1234567d" or "9876543B".
+	// The digits and unit must be at least 7 bytes long, the length of an
+	// abbreviated git commit hash.
+	IdentHex
+
+	// IdentAll enables all recognisers.
+	IdentAll = IdentLuhn | IdentISBN | IdentHex
+)
+
+// isIdentifier reports if number b, which consists of integer digits and
+// an optional fraction followed by suffix, should be treated as an
+// identifier and left as is.
+//
+// Numbers with a leading zero, such as zero-padded IDs like "000123456",
+// are always treated as identifiers.
+func isIdentifier(opts *Options, b, suffix []byte) bool {
+	if len(b) > 1 && b[0] == '0' && isDigit(b[1]) {
+		return true
+	}
+	if opts.MaxDigits <= 0 && opts.Identifiers == 0 {
+		return false
+	}
+	n := 0
+	for n < len(b) && isDigit(b[n]) {
+		n++
+	}
+	if opts.MaxDigits > 0 && n > opts.MaxDigits {
+		return true
+	}
+	if n != len(b) || opts.Identifiers == 0 {
+		return false // the checksum recognisers only apply to integers
+	}
+	if opts.Identifiers&IdentLuhn != 0 && 12 <= n && n <= 19 && luhnValid(b) {
+		return true
+	}
+	if opts.Identifiers&IdentISBN != 0 && isbnValid(b) {
+		return true
+	}
+	if opts.Identifiers&IdentHex != 0 && len(suffix) != 0 && n+len(suffix) >= 7 && isHexLetters(suffix) {
+		return true
+	}
+	return false
+}
+
+// isHexLetters reports if b consists only of the letters a-f and A-F.
+func isHexLetters(b []byte) bool {
+	for _, c := range b {
+		if ('a' > c || c > 'f') && ('A' > c || c > 'F') {
+			return false
+		}
+	}
+	return true
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+// luhnValid reports if the digits of b have a valid Luhn check digit.
+func luhnValid(b []byte) bool {
+	sum := 0
+	double := false
+	for i := len(b) - 1; i >= 0; i-- {
+		d := int(b[i] - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+	}
+	return sum%10 == 0
+}
+
+// isbnValid reports if the digits of b are a valid ISBN-10 or ISBN-13.
+func isbnValid(b []byte) bool {
+	switch len(b) {
+	case 10:
+		sum := 0
+		for i, c := range b {
+			sum += (10 - i) * int(c-'0')
+		}
+		return sum%11 == 0
+	case 13:
+		if b[0] != '9' || b[1] != '7' || (b[2] != '8' && b[2] != '9') {
+			return false
+		}
+		sum := 0
+		for i, c := range b {
+			if i%2 == 0 {
+				sum += int(c - '0')
+			} else {
+				sum += 3 * int(c-'0')
+			}
+		}
+		return sum%10 == 0
+	}
+	return false
+}
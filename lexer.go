@@ -0,0 +1,524 @@
+package num
+
+import (
+	"bytes"
+	"encoding/binary"
+	"unicode"
+	"unicode/utf8"
+)
+
+// A tokenWriter consumes the tokens produced by a lexer.  The token and its
+// Raw bytes are only valid for the duration of the call.
+type tokenWriter interface {
+	writeToken(t *Token)
+
+	// stripped is called when a marker is removed from the output, with
+	// the input offset of the byte after the marker.
+	stripped(offset int64)
+}
+
+// A lexer splits a stream of bytes into text and number tokens.  It is the
+// push based core shared by Num and Tokenizer.
+type lexer struct {
+	scan    *scanner
+	opts    Options
+	units   map[string]bool
+	off, on marker // Markers.Off and Markers.On matchers
+	paused  bool   // formatting is paused by an Off marker
+	matched int    // number of bytes of the current marker matched
+	held    int    // number of bytes of an incomplete rune before the matched bytes
+	maxTok  int    // maximum length of a number token
+	long    bool   // the pending number is too long and is passed through
+	stats   Stats
+	partial []byte // pending number and held back marker bytes
+
+	// The tokens passed to the tokenWriter.  The number fields of text are
+	// never set, so only its position and Raw bytes change.
+	text Token
+	num  Token
+
+	// position of the next token
+	offset int64
+	line   int
+	col    int
+}
+
+func (l *lexer) setOptions(opts Options) {
+	l.opts = opts
+	l.units = nil
+	l.maxTok = 0
+	if l.scan != nil {
+		l.scan.setQuotes(opts.Quotes)
+	}
+	if opts.Markers.enabled() {
+		l.off = newMarker(opts.Markers.Off)
+		l.on = newMarker(opts.Markers.On)
+	}
+}
+
+func (l *lexer) init() {
+	if l.scan == nil {
+		l.scan = newScanner()
+		l.scan.setQuotes(l.opts.Quotes)
+	}
+	if l.units == nil {
+		l.units = unitSet(l.opts.Units)
+	}
+	if l.maxTok == 0 {
+		l.maxTok = l.opts.MaxTokenLen
+		if l.maxTok <= 0 {
+			l.maxTok = DefaultMaxTokenLen
+		}
+	}
+	if l.line == 0 {
+		l.line = 1
+		l.col = 1
+	}
+}
+
+func (l *lexer) reset() {
+	if l.scan != nil {
+		l.scan.reset()
+	}
+	l.paused = false
+	l.matched = 0
+	l.held = 0
+	l.long = false
+	l.stats = Stats{}
+	l.partial = l.partial[:0]
+	l.offset = 0
+	l.line = 1
+	l.col = 1
+}
+
+// write, scans p and passes all complete tokens to w.  A number, or an
+// incomplete rune, at the end of p is held back until the next call to
+// write or flush.
+func (l *lexer) write(p []byte, w tokenWriter) error {
+	if len(p) == 0 {
+		return nil
+	}
+	l.init()
+	l.stats.BytesIn += int64(len(p))
+	if len(l.partial) != 0 {
+		l.stats.Carries++
+	}
+	// Complete the bytes carried over from the previous write with the
+	// start of p, so that the rest of p is scanned in place.
+	for len(l.partial) != 0 && len(p) != 0 {
+		k := l.carryLen(p)
+		start := len(l.partial)
+		l.partial = append(l.partial, p[:k]...)
+		if err := l.writeChunk(l.partial, start, w); err != nil {
+			return err
+		}
+		p = p[k:]
+	}
+	if len(p) == 0 {
+		return nil
+	}
+	return l.writeChunk(p, 0, w)
+}
+
+// writeChunk, scans b, of which the first start bytes were carried over from
+// the previous chunk, and passes all complete tokens to w.
+func (l *lexer) writeChunk(b []byte, start int, w tokenWriter) error {
+	var lastWrite int
+	var err error
+	if l.opts.Markers.enabled() {
+		lastWrite, err = l.writeMarked(b, start, w)
+	} else {
+		lastWrite, err = l.scanBytes(b, start-l.held, len(b), 0, w, false)
+	}
+	if err != nil {
+		return err
+	}
+	end := len(b) - l.matched - l.held
+	if l.scan.inNum() {
+		if !l.long && end-lastWrite <= l.maxTok {
+			l.partial = append(l.partial[:0], b[lastWrite:]...)
+			return nil
+		}
+		// The pending number is too long: write it as text and pass the
+		// rest of it through until the scanner reaches a boundary.  It is
+		// counted by writeNumber if it ends as a number.
+		l.long = true
+	}
+	// hold back bytes that may be the start of a marker or a rune
+	l.writeText(b[lastWrite:end], w)
+	l.partial = append(l.partial[:0], b[end:]...)
+	return nil
+}
+
+// carryLen, returns the number of bytes at the start of p that complete the
+// pending number, incomplete rune or partial marker carried over in
+// l.partial.  The scanner and marker states are only simulated, so bytes
+// may still be pending after the carried over bytes and p[:n] are scanned.
+func (l *lexer) carryLen(p []byte) int {
+	n := 0
+	if !l.paused && l.scan.inNum() {
+		tab, st := l.scan.tab, l.scan.state
+		for n < len(p) && n <= l.maxTok && numState[st] {
+			t := tab[int(st)*classStride+int(byteClass[p[n]])]
+			if t>>8 == scanRune {
+				n += utf8.UTFMax // decoded by scanBytes
+				break
+			}
+			st = uint8(t)
+			n++
+		}
+	}
+	if l.held != 0 && n < utf8.UTFMax {
+		n = utf8.UTFMax
+	}
+	if l.matched != 0 {
+		m := &l.off
+		if l.paused {
+			m = &l.on
+		}
+		i, matched := 0, l.matched
+		for ; i < len(p) && (i < n || matched != 0) && matched != len(m.s); i++ {
+			matched = m.next(matched, p[i])
+		}
+		n = i
+	}
+	if n < 1 {
+		n = 1
+	}
+	if n > len(p) {
+		n = len(p)
+	}
+	return n
+}
+
+// flush, passes any pending number or text to w.
+func (l *lexer) flush(w tokenWriter) error {
+	if len(l.partial) == 0 {
+		return nil
+	}
+	var lastWrite int
+	if n := l.matched + l.held; n != 0 && !l.paused {
+		// the held back bytes are not a marker or a complete rune
+		var err error
+		lastWrite, err = l.scanBytes(l.partial, len(l.partial)-n, len(l.partial), 0, w, true)
+		if err != nil {
+			return err
+		}
+	}
+	l.matched = 0
+	l.held = 0
+	if l.scan.inNum() {
+		l.writeNumber(l.partial[lastWrite:], w)
+		l.scan.restart()
+	} else {
+		l.writeText(l.partial[lastWrite:], w)
+	}
+	l.partial = l.partial[:0]
+	return nil
+}
+
+// scanBytes, scans b[i:end] and passes any text and numbers before the
+// pending text or number, which starts at lastWrite, to w.  It returns the
+// new start of the pending text or number.  Unless eof is set, scanning
+// stops at an incomplete rune at the end of b[i:end] and l.held is set to
+// its length.
+func (l *lexer) scanBytes(b []byte, i, end, lastWrite int, w tokenWriter, eof bool) (int, error) {
+	// The scanner state is kept in a local variable in the loop; only the
+	// scan codes that end a token are handled.
+	s := l.scan
+	tab, st := s.tab, s.state
+	fast := tab == &scanTables[QuoteNone]
+	skipped := i // bytes before skipped were considered by the fast path
+	l.held = 0
+	for ; i < end; i++ {
+		if fast && st <= stInValue && i >= skipped {
+			// Without quotes every space returns the scanner to stBegin
+			// and a span without digits contains no numbers, so skip to
+			// the last space before the next digit.
+			j := i + indexDigit(b[i:end])
+			if j < i {
+				j = end
+			}
+			if k := lastSpace(b[i:j]); k > 0 {
+				i += k
+			}
+			skipped = j
+		}
+		t := tab[int(st)*classStride+int(byteClass[b[i]])]
+		st = uint8(t)
+		switch t >> 8 {
+		case scanBeginNum:
+			l.writeText(b[lastWrite:i], w)
+			lastWrite = i
+			l.long = false
+		case scanEndNum:
+			l.writeNumber(b[lastWrite:i], w)
+			lastWrite = i
+		case scanError:
+			s.error(b[i], ErrInvalidState)
+			return lastWrite, l.scanError(b, lastWrite, i)
+		case scanRune:
+			cls, size := runeClass(b[i:end], eof)
+			if size == 0 {
+				l.held = end - i
+				s.state = st
+				return lastWrite, nil
+			}
+			t = tab[int(st)*classStride+cls]
+			st = uint8(t)
+			switch t >> 8 {
+			case scanBeginNum:
+				l.writeText(b[lastWrite:i], w)
+				lastWrite = i
+				l.long = false
+			case scanEndNum:
+				l.writeNumber(b[lastWrite:i], w)
+				lastWrite = i
+			}
+			i += size - 1
+		}
+	}
+	s.state = st
+	return lastWrite, nil
+}
+
+// runeClass, returns the byte class used to step the scanner by the rune at
+// the start of b, clsSpace for a Unicode space and otherwise clsHigh, and
+// the number of bytes it covers.  A size of 0 is returned if b holds an
+// incomplete rune and eof is not set.
+func runeClass(b []byte, eof bool) (cls, size int) {
+	r, size := utf8.DecodeRune(b)
+	if r == utf8.RuneError && !eof && !utf8.FullRune(b) {
+		return 0, 0
+	}
+	if unicode.IsSpace(r) {
+		return clsSpace, size
+	}
+	return clsHigh, 1
+}
+
+const (
+	lsb = 0x0101010101010101
+	msb = 0x8080808080808080
+)
+
+// indexDigit, returns the index of the first digit in b, or -1 if b has no
+// digits.  It tests 8 bytes at a time.
+func indexDigit(b []byte) int {
+	i := 0
+	for ; i+8 <= len(b); i += 8 {
+		// The high bit of a byte of x is set if the byte is in the range
+		// ('0'-1, '9'+1).
+		x := binary.LittleEndian.Uint64(b[i:])
+		y := x & (lsb * 127)
+		if (lsb*(127+'9'+1)-y)&^x&(y+lsb*(127-('0'-1)))&msb == 0 {
+			continue
+		}
+		for j := i; j < i+8; j++ {
+			if isDigit(b[j]) {
+				return j
+			}
+		}
+	}
+	for ; i < len(b); i++ {
+		if isDigit(b[i]) {
+			return i
+		}
+	}
+	return -1
+}
+
+// lastSpace, returns the index of the last ASCII space in b, or -1.
+func lastSpace(b []byte) int {
+	for i := len(b) - 1; i >= 0; i-- {
+		if isSpace(rune(b[i])) {
+			return i
+		}
+	}
+	return -1
+}
+
+// scanError, fills in the position of the scanner error caused by b[i].
+// The lexer position is that of b[lastWrite].
+func (l *lexer) scanError(b []byte, lastWrite, i int) error {
+	se, ok := l.scan.err.(*ScannerError)
+	if !ok {
+		return l.scan.err
+	}
+	const context = 16
+	lo, hi := i-context, i+context
+	if lo < 0 {
+		lo = 0
+	}
+	if hi > len(b) {
+		hi = len(b)
+	}
+	se.Offset = l.offset + int64(i-lastWrite)
+	se.Line = l.line
+	se.Column = l.col + i - lastWrite
+	if j := bytes.LastIndexByte(b[lastWrite:i], '\n'); j >= 0 {
+		se.Line += bytes.Count(b[lastWrite:i], []byte{'\n'})
+		se.Column = i - (lastWrite + j)
+	}
+	se.Snippet = string(b[lo:hi])
+	return se
+}
+
+// advance, advances the position past b.
+func (l *lexer) advance(b []byte) {
+	l.offset += int64(len(b))
+	if len(b) <= 16 {
+		// short text, such as the spaces between numbers
+		for _, c := range b {
+			if c == '\n' {
+				l.line++
+				l.col = 1
+			} else {
+				l.col++
+			}
+		}
+		return
+	}
+	if i := bytes.LastIndexByte(b, '\n'); i >= 0 {
+		l.line += bytes.Count(b[:i+1], []byte{'\n'})
+		l.col = len(b) - i
+	} else {
+		l.col += len(b)
+	}
+}
+
+// The fields of the tokens are set one by one, rather than with a composite
+// literal, since writing a whole Token for every token is measurable.
+
+func (l *lexer) writeText(b []byte, w tokenWriter) {
+	if len(b) != 0 {
+		t := &l.text
+		t.Raw = b
+		t.Offset, t.Line, t.Column = l.offset, l.line, l.col
+		l.advance(b)
+		w.writeToken(t)
+	}
+}
+
+// writeNumber, passes number token b to w.  Tokens that are not numbers,
+// such as numbers with an unknown prefix or suffix or that are longer than
+// the maximum token length, are passed as text.
+func (l *lexer) writeNumber(b []byte, w tokenWriter) {
+	if l.long || len(b) > l.maxTok {
+		l.stats.SkippedLong++
+		l.long = false
+		l.writeText(b, w)
+		return
+	}
+	t, ok := l.parseNumber(b)
+	if !ok {
+		l.writeText(b, w)
+		return
+	}
+	tok := &l.num
+	tok.Kind = Number
+	tok.Raw = b
+	tok.Offset, tok.Line, tok.Column = l.offset, l.line, l.col
+	// a number does not contain newlines
+	l.offset += int64(len(b))
+	l.col += len(b)
+	tok.Neg = t.neg
+	tok.Int = Span{t.intStart, t.intEnd}
+	tok.Frac = Span{t.intEnd, t.fracEnd}
+	if t.fracEnd != t.intEnd {
+		tok.Frac.Start++ // skip '.'
+	}
+	tok.Grouped = t.grouped
+	tok.Ident = !t.grouped && isIdentifier(&l.opts, b[t.intStart:t.fracEnd], b[t.fracEnd:t.suffixEnd])
+	l.stats.Numbers++
+	if tok.Ident {
+		l.stats.SkippedIdent++
+	}
+	if len(b) > l.stats.MaxLen {
+		l.stats.MaxLen = len(b)
+	}
+	w.writeToken(tok)
+}
+
+// A numSpan holds the offsets of the parts of a number token.
+type numSpan struct {
+	intStart, intEnd int  // integer digits
+	fracEnd          int  // end of the fraction, including the '.'
+	suffixEnd        int  // end of the unit, currency or percent suffix
+	grouped          bool // integer contains thousands separators
+	neg              bool // negative sign or accounting negative
+}
+
+// parseNumber, parses number token b, which has the form:
+//
+//	['('] ['-'] [currency] ['-'] digits [',' digits]... ['.' digits] [suffix] [')' | trail]
+//
+// The suffix may be a unit, a currency or a percent or permille sign.  The
+// parenthesis are an accounting negative if both are present, otherwise
+// they are treated as punctuation.  False is returned if b is not a number.
+func (l *lexer) parseNumber(b []byte) (t numSpan, ok bool) {
+	i := 0
+	open := i < len(b) && b[i] == '('
+	if open {
+		i++
+	}
+	t.neg = i < len(b) && b[i] == '-'
+	if t.neg {
+		i++
+	}
+	j := i
+	for j < len(b) && b[j] != '-' && !isDigit(b[j]) {
+		j++
+	}
+	if j > i {
+		if !isCurrency(b[i:j]) {
+			return t, false
+		}
+		i = j
+		if !t.neg && i < len(b) && b[i] == '-' {
+			t.neg = true
+			i++
+		}
+	}
+	t.intStart = i
+	for i < len(b) && isDigit(b[i]) {
+		i++
+	}
+	if i == t.intStart {
+		return t, false
+	}
+	for i+1 < len(b) && b[i] == ',' && isDigit(b[i+1]) {
+		t.grouped = true
+		for i++; i < len(b) && isDigit(b[i]); i++ {
+		}
+	}
+	t.intEnd = i
+	if i < len(b) && b[i] == '.' {
+		i++
+		for i < len(b) && isDigit(b[i]) {
+			i++
+		}
+	}
+	t.fracEnd = i
+	j = len(b)
+	if j > i && isTrail(int(b[j-1])) {
+		j--
+	} else if j > i && b[j-1] == ')' {
+		j--
+		t.neg = t.neg || open
+	}
+	if suffix := b[i:j]; len(suffix) != 0 && !l.isSuffix(suffix) {
+		return t, false
+	}
+	t.suffixEnd = j
+	return t, true
+}
+
+// isSuffix, reports if b may directly follow a number.
+func (l *lexer) isSuffix(b []byte) bool {
+	switch string(b) {
+	case "%", "‰":
+		return true
+	}
+	return l.units[string(b)] || isCurrency(b)
+}
@@ -0,0 +1,109 @@
+package num
+
+// Markers are in-band strings, such as "num:off" and "num:on", that pause
+// and resume formatting.  Text between an Off marker and the following On
+// marker is passed through verbatim.  Markers are recognised anywhere in
+// the stream, including when split across calls to Write, and end any
+// number that directly precedes them.
+type Markers struct {
+	// Off pauses formatting.
+	Off string
+
+	// On resumes formatting.
+	On string
+
+	// Strip removes the markers from the output.
+	Strip bool
+}
+
+func (m *Markers) enabled() bool {
+	return m.Off != "" && m.On != ""
+}
+
+// A marker matches a marker string in a stream of bytes using the
+// Knuth-Morris-Pratt algorithm.
+type marker struct {
+	s    string
+	fail []int
+}
+
+func newMarker(s string) marker {
+	m := marker{s: s, fail: make([]int, len(s))}
+	for i, k := 1, 0; i < len(s); i++ {
+		for k > 0 && s[i] != s[k] {
+			k = m.fail[k-1]
+		}
+		if s[i] == s[k] {
+			k++
+		}
+		m.fail[i] = k
+	}
+	return m
+}
+
+// next returns the number of bytes of the marker matched after reading c,
+// given that n bytes were previously matched.
+func (m *marker) next(n int, c byte) int {
+	if n == len(m.s) {
+		n = m.fail[n-1]
+	}
+	for n > 0 && m.s[n] != c {
+		n = m.fail[n-1]
+	}
+	if m.s[n] == c {
+		n++
+	}
+	return n
+}
+
+// writeMarked, is the write loop used when markers are enabled.  Bytes that
+// may be the start of a marker are held back and only scanned once they
+// are known not to be part of a marker.  It returns the start of the
+// pending text or number.
+func (l *lexer) writeMarked(b []byte, start int, w tokenWriter) (int, error) {
+	var err error
+	lastWrite := 0
+	scanned := start - l.matched - l.held
+	for i := start; i < len(b); i++ {
+		m := &l.off
+		if l.paused {
+			m = &l.on
+		}
+		l.matched = m.next(l.matched, b[i])
+		if l.matched < len(m.s) {
+			if !l.paused {
+				end := i + 1 - l.matched
+				lastWrite, err = l.scanBytes(b, scanned, end, lastWrite, w, false)
+				if err != nil {
+					return lastWrite, err
+				}
+				scanned = end - l.held
+			}
+			continue
+		}
+		// The marker is b[ms:i+1] and ends any pending number.
+		ms := i + 1 - len(m.s)
+		if !l.paused {
+			lastWrite, err = l.scanBytes(b, scanned, ms, lastWrite, w, true)
+			if err != nil {
+				return lastWrite, err
+			}
+			if l.scan.inNum() {
+				l.writeNumber(b[lastWrite:ms], w)
+				lastWrite = ms
+			}
+		}
+		l.writeText(b[lastWrite:ms], w)
+		lastWrite = ms
+		if l.opts.Markers.Strip {
+			l.advance(b[ms : i+1])
+			w.stripped(l.offset)
+			lastWrite = i + 1
+		}
+		l.scan.restart()
+		l.paused = !l.paused
+		l.matched = 0
+		scanned = i + 1
+	}
+	return lastWrite, nil
+}
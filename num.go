@@ -3,27 +3,144 @@ package num
 
 import (
 	"bytes"
+	"context"
 	"errors"
+	"fmt"
 	"io"
 	"strconv"
-	"strings"
+	"sync"
+	"time"
 )
 
+// Options control how numbers are detected and formatted.  The zero value
+// formats every number that is not an identifier.
+type Options struct {
+	// MaxDigits is the maximum number of integer digits a number may have
+	// and still be formatted.  Longer digit runs, such as order IDs and
+	// phone numbers, are passed through verbatim.  Zero means no limit.
+	MaxDigits int
+
+	// Identifiers selects the checksum based recognisers used to detect
+	// numbers that are identifiers.  Matching numbers are passed through
+	// verbatim.
+	Identifiers IdentKind
+
+	// Units is the table of unit suffixes, such as "ns" or "KiB", that may
+	// directly follow a number ("123456789ns").  Numbers followed by any
+	// other letters are passed through verbatim.  If nil, DefaultUnits is
+	// used.  An empty, non-nil table disables unit suffixes.
+	Units []string
+
+	// Regroup selects how numbers that already contain separators are
+	// handled.  Correctly grouped numbers, such as "1,234,567", are always
+	// left as is and thousands separated numbers whose first group is too
+	// long, such as "1234,567", are always regrouped to "1,234,567".  If
+	// Regroup is true numbers grouped in the Indian style, such as
+	// "12,34,567", are regrouped too, so that every number is grouped
+	// consistently.  Other groupings, such as "1,2,3", are not thousands
+	// separated and are always left as is.  In both modes formatting
+	// already formatted text does not change it.
+	Regroup bool
+
+	// Quotes selects how numbers in quoted strings are handled.
+	Quotes QuoteMode
+
+	// Markers are in-band strings that pause and resume formatting.
+	Markers Markers
+
+	// MaxTokenLen is the maximum length in bytes of a number, including
+	// any sign, currency and suffix.  Longer runs, such as a dumped bitmap
+	// of digits, are passed through verbatim and at most MaxTokenLen bytes
+	// of a pending number are buffered.  If zero, DefaultMaxTokenLen is
+	// used.
+	MaxTokenLen int
+
+	// Replace, if not nil, is called for every number to decide how it is
+	// rendered.
+	Replace ReplaceFunc
+
+	// Offsets, if true, records an OffsetMap that maps byte offsets
+	// between the input and the output, see Num.Offsets.
+	Offsets bool
+}
+
+// A ReplaceFunc renders number token t, which includes the parsed sign,
+// integer and fraction parts and the position of the number, in place of
+// the default formatting.  It appends the replacement to dst and returns
+// the extended buffer and true, or returns false to use the default
+// formatting.  Identifiers and numbers that are already grouped are passed
+// too, see Token.Ident and Token.Grouped.  The token and its Raw bytes are
+// only valid for the duration of the call.
+type ReplaceFunc func(dst []byte, t *Token) ([]byte, bool)
+
+// DefaultMaxTokenLen is the maximum token length used when
+// Options.MaxTokenLen is zero.
+const DefaultMaxTokenLen = 4096
+
+// A QuoteMode selects how numbers in quoted strings are handled.
+//
+// Quoted strings start with a double or single quote at the beginning of
+// a value, may contain backslash escapes and doubled (escaped) quotes, and
+// end at the matching quote or the end of the line.
+type QuoteMode int
+
+const (
+	// QuoteNone does not track quoted strings, quotes are treated as
+	// ordinary punctuation and numbers in them are formatted.
+	QuoteNone QuoteMode = iota
+
+	// QuoteSkip tracks quoted strings and leaves numbers in them as is.
+	QuoteSkip
+
+	// QuoteFormat tracks quoted strings and formats numbers in them.
+	QuoteFormat
+)
+
+// DefaultUnits is the unit suffix table used when Options.Units is nil.
+var DefaultUnits = []string{
+	// time
+	"ns", "us", "µs", "μs", "ms", "s", "m", "h", "d",
+	// sizes
+	"b", "B", "kB", "KB", "MB", "GB", "TB", "PB", "EB",
+	"KiB", "MiB", "GiB", "TiB", "PiB", "EiB",
+	// rates and frequencies
+	"B/s", "kB/s", "KB/s", "MB/s", "GB/s", "KiB/s", "MiB/s", "GiB/s",
+	"bps", "kbps", "Kbps", "Mbps", "Gbps",
+	"Hz", "kHz", "MHz", "GHz",
+	"ops", "ops/s", "req/s", "rps", "qps",
+	// go test -bench
+	"ns/op", "B/op", "allocs/op", "MB/op",
+}
+
+func unitSet(units []string) map[string]bool {
+	if units == nil {
+		units = DefaultUnits
+	}
+	m := make(map[string]bool, len(units))
+	for _, u := range units {
+		m[u] = true
+	}
+	return m
+}
+
 type Num struct {
 	buf     bytes.Buffer
-	scan    *scanner
-	partial []byte
+	lex     lexer
 	scratch []byte
+	offsets OffsetMap
 }
 
 func New() *Num {
-	return &Num{scan: newScanner()}
+	return &Num{lex: lexer{scan: newScanner()}}
+}
+
+// SetOptions, sets the options used to detect and format numbers.
+func (n *Num) SetOptions(opts Options) {
+	n.lex.setOptions(opts)
 }
 
 func (n *Num) init() {
-	if n.scan == nil {
-		n.scan = newScanner()
-	}
+	n.lex.init()
 	if cap(n.scratch) == 0 {
 		n.scratch = make([]byte, 0, 64)
 	}
@@ -32,10 +149,8 @@ func (n *Num) init() {
 // Reset, resets the internal state of Num.
 func (n *Num) Reset() {
 	n.buf.Reset()
-	if n.scan != nil {
-		n.scan.reset()
-	}
-	n.partial = n.partial[:0]
+	n.offsets.Reset()
+	n.lex.reset()
 	n.scratch = n.scratch[:0]
 }
 
@@ -48,34 +163,8 @@ func (n *Num) Write(p []byte) (int, error) {
 		return 0, nil
 	}
 	n.init()
-	start := len(n.partial)
-	var b []byte
-	if start != 0 {
-		n.partial = append(n.partial, p...)
-		b = n.partial
-	} else {
-		b = p
-	}
-	var lastWrite int
-	for i := start; i < len(b); i++ {
-		n.scan.bytes++
-		switch n.scan.step(n.scan, int(b[i])) {
-		case scanBeginNum:
-			n.buf.Write(b[lastWrite:i])
-			lastWrite = i
-		case scanEndNum:
-			n.scratch = formatNumber(n.scratch[:0], b[lastWrite:i])
-			n.buf.Write(n.scratch)
-			lastWrite = i
-		case scanError:
-			return i, n.scan.err
-		}
-	}
-	if n.scan.parseState == parseNum {
-		n.partial = append(n.partial[:0], b[lastWrite:]...)
-	} else {
-		n.buf.Write(b[lastWrite:])
-		n.partial = n.partial[:0]
+	if err := n.lex.write(p, n); err != nil {
+		return 0, err
 	}
 	return len(p), nil
 }
@@ -83,42 +172,116 @@ func (n *Num) Write(p []byte) (int, error) {
 // Flush, formats any partially read numbers and flushes them into the internal
 // buffer.
 func (n *Num) Flush() error {
-	if len(n.partial) == 0 {
-		return nil
+	return n.lex.flush(n)
+}
+
+// writeToken, writes token t to the internal buffer and records the change
+// in length of numbers in the offset map.
+func (n *Num) writeToken(t *Token) {
+	if t.Kind == Text {
+		n.write(t.Raw)
+		return
+	}
+	if n.lex.opts.Offsets {
+		out := n.lex.stats.BytesOut
+		n.formatToken(t)
+		if length := n.lex.stats.BytesOut - out; length != int64(len(t.Raw)) {
+			n.offsets.add(t.Offset+int64(len(t.Raw)), out+length)
+		}
+		return
 	}
-	if n.scan.parseState == parseNum {
-		n.scratch = formatNumber(n.scratch[:0], n.partial)
-		n.buf.Write(n.scratch)
-		n.scan.reset()
-		n.partial = n.partial[:0]
+	n.formatToken(t)
+}
+
+// stripped, records the removal of a marker that ends before offset in the
+// offset map.
+func (n *Num) stripped(offset int64) {
+	if n.lex.opts.Offsets {
+		n.offsets.add(offset, n.lex.stats.BytesOut)
 	}
-	return nil
 }
 
-// WriteTo, flushes any partial numbers and writes the contents of Num's
-// internal buffer to w.
-func (n *Num) WriteTo(w io.Writer) (int64, error) {
-	if err := n.Flush(); err != nil {
-		return 0, err
+// formatToken, writes number token t to the internal buffer.  Identifiers and
+// numbers that are already grouped are written verbatim, all other numbers
+// are formatted or passed to Options.Replace.
+func (n *Num) formatToken(t *Token) {
+	b := t.Raw
+	if n.lex.opts.Replace != nil {
+		if out, ok := n.lex.opts.Replace(n.scratch[:0], t); ok {
+			n.lex.stats.Replaced++
+			n.write(out)
+			return
+		}
 	}
+	if t.Ident {
+		n.write(b)
+		return
+	}
+	digits := b[t.Int.Start:t.Int.End]
+	if len(digits) <= 3 && !t.Grouped {
+		n.write(b) // too short to group
+		return
+	}
+	if t.Grouped && !n.regroupable(digits) {
+		n.lex.stats.SkippedGrouped++
+		n.write(b)
+		return
+	}
+	n.scratch = append(n.scratch[:0], b[:t.Int.Start]...)
+	if t.Grouped {
+		n.scratch = regroup(n.scratch, digits)
+	} else {
+		n.scratch = formatNumber(n.scratch, digits)
+	}
+	n.scratch = append(n.scratch, b[t.Int.End:]...)
+	n.lex.stats.Grouped++ // the separators of the number always change
+	n.write(n.scratch)
+}
+
+func (n *Num) write(b []byte) {
+	n.lex.stats.BytesOut += int64(len(b))
+	n.buf.Write(b)
+}
+
+// Offsets, returns the map of byte offsets between the input and the
+// output written since Num was created or last reset.  The map is only
+// recorded if Options.Offsets is set.  Numbers are only added to the map
+// once they are complete, see Flush.
+func (n *Num) Offsets() *OffsetMap {
+	return &n.offsets
+}
+
+// Stats, returns the counters of the work done since Num was created or
+// last reset.
+func (n *Num) Stats() Stats {
+	return n.lex.stats
+}
+
+// WriteTo, writes the completed contents of Num's internal buffer to w.
+// A number that is still pending, because it may continue in the next call
+// to Write, is not written until Flush is called.
+func (n *Num) WriteTo(w io.Writer) (int64, error) {
 	return n.buf.WriteTo(w)
 }
 
-// Read, flushes any partial numbers and reads up to len(p) bytes from the
-// internal buffer into p.
+// Read, reads up to len(p) bytes of the completed contents of Num's internal
+// buffer into p.  Like WriteTo, Read does not finish a pending number: call
+// Flush once all input has been written.  If the buffer has no completed
+// output Read returns io.EOF.
 func (n *Num) Read(p []byte) (int, error) {
-	if err := n.Flush(); err != nil {
-		return 0, err
-	}
 	return n.buf.Read(p)
 }
 
 // An Encoder is a stream formatter.
 type Encoder struct {
-	w   io.Writer
-	n   Num
-	buf []byte
-	err error
+	w    io.Writer
+	n    Num
+	buf  []byte
+	name string // name of the input, used in scanner errors
+	err  error
+
+	lineBuffered bool
+	idle         time.Duration // idle interval after which pending output is flushed
 }
 
 // NewEncoder, returns an Encoder that writes to w.
@@ -126,34 +289,239 @@ func NewEncoder(w io.Writer) *Encoder {
 	return &Encoder{w: w}
 }
 
+// SetOptions, sets the options used to detect and format numbers.
+func (e *Encoder) SetOptions(opts Options) {
+	e.n.SetOptions(opts)
+}
+
+// Reset, discards the state of the Encoder, including any error, pending
+// number and buffered output, and makes it write to w.  Allocated buffers
+// are kept, as are the options, line buffering and idle flush interval,
+// so an Encoder can be reused, for example from a sync.Pool:
+//
+//	enc := pool.Get().(*num.Encoder)
+//	enc.Reset(w)
+//	err := enc.Encode(r)
+//	pool.Put(enc)
+func (e *Encoder) Reset(w io.Writer) {
+	e.w = w
+	e.n.Reset()
+	e.name = ""
+	e.err = nil
+}
+
+// Offsets, returns the map of byte offsets between the input and the
+// output of the Encoder, see Num.Offsets.
+func (e *Encoder) Offsets() *OffsetMap {
+	return e.n.Offsets()
+}
+
+// Stats, returns the counters of the work done since the Encoder was
+// created or last reset.
+func (e *Encoder) Stats() Stats {
+	return e.n.Stats()
+}
+
+// Err, returns the error, if any, that stopped the Encoder.  Errors are
+// sticky: once an error occurs all later calls to Encode return it until
+// Reset is called.
+func (e *Encoder) Err() error {
+	return e.err
+}
+
+// SetLineBuffered, sets whether the Encoder is line-buffered.  A
+// line-buffered Encoder flushes the underlying io.Writer, if it has a Flush
+// method such as *bufio.Writer, after writing the output of every read, so
+// that completed lines are emitted immediately.  This is intended for
+// interactive pipes, such as "tail -f app.log | num".
+func (e *Encoder) SetLineBuffered(lineBuffered bool) {
+	e.lineBuffered = lineBuffered
+}
+
+// SetIdleFlush, sets the interval after which the Encoder finishes and
+// writes a pending number, and flushes the underlying io.Writer, when no
+// input has arrived.  A number that continues after the idle interval is
+// formatted as two numbers.  Zero, the default, disables the idle flush.
+//
+// With an idle interval Encode reads from r in a separate goroutine.  If
+// Encode returns early due to an error, the goroutine exits once its
+// pending call to r.Read returns.
+func (e *Encoder) SetIdleFlush(d time.Duration) {
+	e.idle = d
+}
+
 // Encode, reads from r formatting any numbers and writes the results to the
-// underlying io.Writer.
+// underlying io.Writer.  Output is written as it is completed, and any
+// pending number is finished once r returns io.EOF.  Read errors other
+// than io.EOF are returned.  If r has a Name method, such as *os.File,
+// scanner errors are prefixed with the name of the input.
 func (e *Encoder) Encode(r io.Reader) error {
+	return e.EncodeContext(context.Background(), r)
+}
+
+// EncodeContext, is like Encode but stops when ctx is done.  The context is
+// checked between reads, and while a read is blocked if the idle flush is
+// enabled.  When ctx is done EncodeContext returns ctx.Err() wrapped with
+// the number of bytes read from r and processed.
+//
+// The output of the bytes processed before the context was done has been
+// written, any pending number is discarded, and the error is kept by the
+// Encoder: all later calls to Encode return it until Reset is called.
+func (e *Encoder) EncodeContext(ctx context.Context, r io.Reader) error {
 	if e.err != nil {
 		return e.err
 	}
+	e.name = ""
+	if f, ok := r.(interface{ Name() string }); ok {
+		e.name = f.Name()
+	}
 	const bufSize = 32 * 1024
 	if len(e.buf) < bufSize {
 		e.buf = make([]byte, bufSize)
 	}
+	if e.idle > 0 {
+		return e.encodeIdle(ctx, r)
+	}
+	var nr int64
 	for {
+		if err := ctx.Err(); err != nil {
+			return e.canceled(err, nr)
+		}
 		n, err := r.Read(e.buf)
-		if err == nil || err == io.EOF {
+		if n > 0 {
 			e.stream(e.buf[:n])
+			nr += int64(n)
+		}
+		if err == io.EOF {
+			break
 		}
 		if err != nil {
+			if e.err == nil {
+				e.err = err
+			}
 			break
 		}
 	}
+	return e.flush()
+}
+
+// canceled, sets the error of the Encoder to context error err after
+// processing n bytes.
+func (e *Encoder) canceled(err error, n int64) error {
+	if e.err == nil {
+		e.err = fmt.Errorf("num: encode stopped after %d bytes: %w", n, err)
+	}
+	return e.err
+}
+
+type readResult struct {
+	p   []byte
+	err error
+}
+
+// encodeIdle, is the Encode loop used when the idle flush is enabled.
+// Reads are made by a separate goroutine, into one of two buffers, so
+// that the Encoder can flush while a read is blocked.
+func (e *Encoder) encodeIdle(ctx context.Context, r io.Reader) error {
+	results := make(chan readResult)
+	free := make(chan []byte, 2)
+	done := make(chan struct{})
+	eof := false
+	defer func() {
+		close(done)
+		if !eof {
+			// The goroutine may still be reading into the buffer.
+			e.buf = nil
+		}
+	}()
+	free <- e.buf
+	free <- make([]byte, len(e.buf))
+	go func() {
+		for {
+			var buf []byte
+			select {
+			case buf = <-free:
+			case <-done:
+				return
+			}
+			n, err := r.Read(buf)
+			select {
+			case results <- readResult{buf[:n], err}:
+			case <-done:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	timer := time.NewTimer(e.idle)
+	defer timer.Stop()
+	var idle <-chan time.Time // nil while there is no new output to flush
+	var nr int64
+	for {
+		select {
+		case <-ctx.Done():
+			return e.canceled(ctx.Err(), nr)
+		case res := <-results:
+			if len(res.p) > 0 {
+				e.stream(res.p)
+				nr += int64(len(res.p))
+			}
+			free <- res.p[:cap(res.p)]
+			if res.err == io.EOF {
+				eof = true
+				return e.flush()
+			}
+			if res.err != nil && e.err == nil {
+				e.err = res.err
+			}
+			if e.err != nil {
+				return e.err
+			}
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(e.idle)
+			idle = timer.C
+		case <-idle:
+			idle = nil
+			if err := e.flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// flush, finishes any pending number and writes it to the underlying
+// io.Writer.
+func (e *Encoder) flush() error {
 	if e.err != nil {
 		return e.err
 	}
 	if err := e.n.Flush(); err != nil {
-		e.err = err
+		e.err = e.inputError(err)
+		return e.err
+	}
+	if err := e.writeTo(); err != nil {
 		return err
 	}
-	if _, err := e.n.WriteTo(e.w); err != nil {
-		e.err = err
+	if e.lineBuffered || e.idle > 0 {
+		return e.flushWriter()
+	}
+	return nil
+}
+
+// flushWriter, flushes the underlying io.Writer if it has a Flush method.
+func (e *Encoder) flushWriter() error {
+	if f, ok := e.w.(interface{ Flush() error }); ok && e.err == nil {
+		if err := f.Flush(); err != nil {
+			e.err = err
+		}
 	}
 	return e.err
 }
@@ -164,9 +532,23 @@ func (e *Encoder) stream(p []byte) error {
 	}
 	_, err := e.n.Write(p)
 	if err != nil {
-		e.err = err
+		e.err = e.inputError(err)
+	}
+	if err := e.writeTo(); err != nil {
+		return err
+	}
+	if e.lineBuffered {
+		return e.flushWriter()
+	}
+	return nil
+}
+
+// inputError, prefixes scanner error err with the name of the input.
+func (e *Encoder) inputError(err error) error {
+	if e.name == "" {
+		return err
 	}
-	return e.writeTo()
+	return fmt.Errorf("%s: %w", e.name, err)
 }
 
 func (e *Encoder) writeTo() error {
@@ -243,13 +625,25 @@ func formatBits(val uint64, neg bool) string {
 	return string(buf[i:])
 }
 
-// func FormatFloat(f float64, fmt byte, prec, bitSize int) string {
+// FormatFloat, is like strconv.FormatFloat but adds thousands separators to
+// the integer part of the result.
 func FormatFloat(f float64, fmt byte, prec, bitSize int) string {
 	s := strconv.FormatFloat(f, fmt, prec, bitSize)
-	if before, after, ok := strings.Cut(s, "."); ok {
-		s = string(formatNumber(nil, []byte(before))) + "." + after
+	i := 0
+	if i < len(s) && (s[i] == '-' || s[i] == '+') {
+		i++
 	}
-	return s
+	j := i
+	for j < len(s) && isDigit(s[j]) {
+		j++
+	}
+	if j-i <= 3 {
+		return s
+	}
+	var a [64]byte
+	b := append(a[:0], s[:i]...)
+	b = formatNumber(b, []byte(s[i:j]))
+	return string(append(b, s[j:]...))
 }
 
 // Format, adds thousands separators to string s.  An error is returned is s
@@ -272,6 +666,70 @@ func AppendFormat(dst, b []byte) []byte {
 	return formatNumber(dst, b)
 }
 
+// A textState is the pooled state of FormatText and AppendText.
+type textState struct {
+	n  Num
+	in []byte // copy of the string passed to FormatText
+}
+
+var textPool = sync.Pool{
+	New: func() interface{} {
+		return &textState{n: Num{lex: lexer{scan: newScanner()}}}
+	},
+}
+
+// maxPooledText is the largest output kept by a pooled textState, so that
+// one large input does not pin its buffers.
+const maxPooledText = 64 * 1024
+
+// FormatText, adds thousands separators to the numbers in text s using the
+// default Options.  Unlike Format, s may contain any text.  If no number
+// changes s is returned, otherwise the only allocation is the result.
+func FormatText(s string) string {
+	ts := textPool.Get().(*textState)
+	ts.in = append(ts.in[:0], s...)
+	out := ts.format(ts.in)
+	if string(out) != s {
+		s = string(out)
+	}
+	ts.free()
+	return s
+}
+
+// AppendText, adds thousands separators to the numbers in text src using
+// the default Options and appends the result to dst.  It does not allocate
+// unless dst must grow.
+func AppendText(dst, src []byte) []byte {
+	ts := textPool.Get().(*textState)
+	dst = append(dst, ts.format(src)...)
+	ts.free()
+	return dst
+}
+
+// format, returns the formatted text b, which is only valid until ts is
+// returned to the pool.
+func (ts *textState) format(b []byte) []byte {
+	if indexDigit(b) < 0 {
+		return b
+	}
+	n := &ts.n
+	n.Reset()
+	if _, err := n.Write(b); err != nil {
+		return b
+	}
+	if err := n.Flush(); err != nil {
+		return b
+	}
+	return n.buf.Bytes()
+}
+
+func (ts *textState) free() {
+	if cap(ts.in) > maxPooledText || ts.n.buf.Cap() > maxPooledText {
+		return
+	}
+	textPool.Put(ts)
+}
+
 func isNumber(b []byte) bool {
 	if len(b) == 0 || b[0] == '.' {
 		return false
@@ -284,6 +742,73 @@ func isNumber(b []byte) bool {
 	return true
 }
 
+// regroupable, reports if grouped integer b is regrouped, see
+// Options.Regroup.
+func (n *Num) regroupable(b []byte) bool {
+	first := bytes.IndexByte(b, ',')
+	if isThousands(b) {
+		return first > 3
+	}
+	return n.lex.opts.Regroup && isIndian(b)
+}
+
+// isIndian reports if grouped integer b is grouped in the Indian style:
+// a last group of three digits preceded by groups of two, after a first
+// group of one or two digits.
+func isIndian(b []byte) bool {
+	groups, n := 0, 0
+	for _, c := range b {
+		if c == ',' {
+			if groups == 0 && n > 2 || groups != 0 && n != 2 {
+				return false
+			}
+			groups++
+			n = 0
+		} else {
+			n++
+		}
+	}
+	return groups >= 2 && n == 3
+}
+
+// isThousands reports if the groups of grouped integer b, after the first,
+// are all three digits long.
+func isThousands(b []byte) bool {
+	n := -1
+	for _, c := range b {
+		if c == ',' {
+			if n != -1 && n != 3 {
+				return false
+			}
+			n = 0
+		} else if n != -1 {
+			n++
+		}
+	}
+	return n == 3
+}
+
+// regroup, appends the digits of grouped integer b to dst with thousands
+// separators.
+func regroup(dst, b []byte) []byte {
+	n := 0
+	for _, c := range b {
+		if c != ',' {
+			n++
+		}
+	}
+	for _, c := range b {
+		if c == ',' {
+			continue
+		}
+		dst = append(dst, c)
+		if n--; n > 0 && n%3 == 0 {
+			dst = append(dst, ',')
+		}
+	}
+	return dst
+}
+
 func formatNumber(dst, b []byte) []byte {
 	n := bytes.IndexByte(b, '.')
 	if n == -1 {
@@ -1,10 +1,19 @@
 package num
 
 import (
+	"bufio"
 	"bytes"
 	"compress/bzip2"
+	"context"
+	"errors"
+	"io"
 	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"testing/iotest"
+	"time"
 )
 
 type testCase struct {
@@ -83,6 +92,26 @@ var numTests = []testCase{
 	},
 }
 
+// streamTests are numTests plus inputs whose numbers straddle the 32 KiB
+// reads of the Encoder and Reader.
+func streamTests() []testCase {
+	pad := strings.Repeat("x", 32*1024-4)
+	return append([]testCase{
+		{In: pad + " 1234567 x", Out: pad + " 1,234,567 x"},
+		{In: pad + " 1234567", Out: pad + " 1,234,567"},
+		{In: "", Out: ""},
+	}, numTests...)
+}
+
+// testReaders wrap the input of the stream tests to vary how it is split
+// across reads.
+var testReaders = map[string]func(io.Reader) io.Reader{
+	"Reader":        func(r io.Reader) io.Reader { return r },
+	"OneByteReader": iotest.OneByteReader,
+	"HalfReader":    iotest.HalfReader,
+	"DataErrReader": iotest.DataErrReader,
+}
+
 func TestNum(t *testing.T) {
 	buf := new(bytes.Buffer)
 	for _, x := range numTests {
@@ -119,6 +148,768 @@ func TestEncoder(t *testing.T) {
 	}
 }
 
+// Test that numbers that straddle reads and the 32 KiB chunks of the
+// Encoder are only finished once the input is complete.
+func TestChunkBoundaries(t *testing.T) {
+	tests := streamTests()
+	for name, fn := range testReaders {
+		for _, x := range tests {
+			var buf bytes.Buffer
+			if err := NewEncoder(&buf).Encode(fn(strings.NewReader(x.In))); err != nil {
+				t.Errorf("Encoder (%s): %v", name, err)
+			}
+			if out := buf.String(); out != x.Out {
+				t.Errorf("Encoder (%s): %.40q\n\tgot:  %.60q\n\twant: %.60q", name, x.In, out, x.Out)
+			}
+
+			// Read the completed output of Num after every write.
+			buf.Reset()
+			n := New()
+			r := fn(strings.NewReader(x.In))
+			p := make([]byte, 7)
+			for {
+				k, err := r.Read(p)
+				n.Write(p[:k])
+				io.Copy(&buf, iotest.HalfReader(n))
+				if err != nil {
+					break
+				}
+			}
+			n.Flush()
+			io.Copy(&buf, iotest.OneByteReader(n))
+			if out := buf.String(); out != x.Out {
+				t.Errorf("Num.Read (%s): %.40q\n\tgot:  %.60q\n\twant: %.60q", name, x.In, out, x.Out)
+			}
+		}
+	}
+}
+
+func TestEncoderReadError(t *testing.T) {
+	errRead := errors.New("read error")
+	var buf bytes.Buffer
+	r := io.MultiReader(strings.NewReader("a 1234567 b 1234"), iotest.ErrReader(errRead))
+	if err := NewEncoder(&buf).Encode(r); err != errRead {
+		t.Errorf("Encode: got error %v want: %v", err, errRead)
+	}
+	if out, want := buf.String(), "a 1,234,567 b "; out != want {
+		t.Errorf("Encode: got output %q want: %q", out, want)
+	}
+}
+
+// A syncBuffer is a bytes.Buffer that is safe for concurrent use.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// waitFor waits until the contents of b are want.
+func waitFor(t *testing.T, b *syncBuffer, want string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for b.String() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out: got %q want: %q", b.String(), want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestEncoderLineBuffered(t *testing.T) {
+	pr, pw := io.Pipe()
+	out := new(syncBuffer)
+	enc := NewEncoder(bufio.NewWriter(out))
+	enc.SetLineBuffered(true)
+	enc.SetIdleFlush(20 * time.Millisecond)
+	errc := make(chan error, 1)
+	go func() { errc <- enc.Encode(pr) }()
+
+	// completed lines are flushed through the bufio.Writer immediately
+	pw.Write([]byte("a 1234567\n"))
+	waitFor(t, out, "a 1,234,567\n")
+
+	// a pending number is flushed once the input is idle
+	pw.Write([]byte("b 7654321"))
+	waitFor(t, out, "a 1,234,567\nb 7,654,321")
+
+	pw.Write([]byte(" c 1234"))
+	pw.Close()
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, out, "a 1,234,567\nb 7,654,321 c 1,234")
+}
+
+func TestEncoderIdleFlushError(t *testing.T) {
+	errRead := errors.New("read error")
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.SetIdleFlush(time.Hour)
+	r := io.MultiReader(strings.NewReader("a 1234567 b 1234"), iotest.ErrReader(errRead))
+	if err := enc.Encode(iotest.OneByteReader(r)); err != errRead {
+		t.Errorf("Encode: got error %v want: %v", err, errRead)
+	}
+	if out, want := buf.String(), "a 1,234,567 b "; out != want {
+		t.Errorf("Encode: got output %q want: %q", out, want)
+	}
+}
+
+// A cancelReader cancels a context once n bytes have been read.
+type cancelReader struct {
+	r      io.Reader
+	n      int
+	cancel context.CancelFunc
+}
+
+func (r *cancelReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if r.n -= n; r.n <= 0 {
+		r.cancel()
+	}
+	return n, err
+}
+
+func TestEncodeContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r := &cancelReader{iotest.OneByteReader(strings.NewReader("a 1234567 b 1234")), 10, cancel}
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	err := enc.EncodeContext(ctx, r)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("EncodeContext: got error %v want: %v", err, context.Canceled)
+	}
+	if want := "num: encode stopped after 10 bytes: context canceled"; err.Error() != want {
+		t.Errorf("EncodeContext: got error %q want: %q", err, want)
+	}
+	if out, want := buf.String(), "a 1,234,567 "; out != want {
+		t.Errorf("EncodeContext: got output %q want: %q", out, want)
+	}
+	if err2 := enc.Encode(strings.NewReader("1234")); err2 != err {
+		t.Errorf("Encode: got error %v want sticky error: %v", err2, err)
+	}
+}
+
+func TestEncodeContextIdle(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	enc := NewEncoder(new(NopWriter))
+	enc.SetIdleFlush(time.Hour)
+	// the read blocks, so the deadline must interrupt it
+	if err := enc.EncodeContext(ctx, pr); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("EncodeContext: got error %v want: %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestEncoderReset(t *testing.T) {
+	errWrite := errors.New("write error")
+	enc := NewEncoder(&errWriter{errWrite})
+	if err := enc.Encode(strings.NewReader("1234567")); err != errWrite {
+		t.Fatalf("Encode: got error %v want: %v", err, errWrite)
+	}
+	if err := enc.Err(); err != errWrite {
+		t.Errorf("Err: got %v want: %v", err, errWrite)
+	}
+
+	// The canceled Encode leaves the number "1234" pending.
+	var buf bytes.Buffer
+	enc.Reset(&buf)
+	if err := enc.Err(); err != nil {
+		t.Errorf("Err: got %v after Reset", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	r := &cancelReader{iotest.OneByteReader(strings.NewReader("a 1234567 b 1234")), 16, cancel}
+	if err := enc.EncodeContext(ctx, r); !errors.Is(err, context.Canceled) {
+		t.Fatalf("EncodeContext: got error %v want: %v", err, context.Canceled)
+	}
+
+	buf.Reset()
+	enc.Reset(&buf)
+	if err := enc.Encode(strings.NewReader("5 7654321")); err != nil {
+		t.Fatal(err)
+	}
+	if out, want := buf.String(), "5 7,654,321"; out != want {
+		t.Errorf("Encode after Reset: got %q want: %q", out, want)
+	}
+}
+
+func TestIdentifiers(t *testing.T) {
+	tests := []struct {
+		opts Options
+		in   string
+		out  string
+	}{
+		{Options{}, "id 000123456 0123.45 0 0.5", "id 000123456 0123.45 0 0.5"},
+		{Options{}, "phone 5551234567", "phone 5,551,234,567"},
+		{Options{MaxDigits: 9}, "phone 5551234567 n 123456789", "phone 5551234567 n 123,456,789"},
+		{Options{MaxDigits: 6}, "x 1234567.89 y 123456.789", "x 1234567.89 y 123,456.789"},
+		{Options{}, "card 4111111111111111", "card 4,111,111,111,111,111"},
+		{Options{Identifiers: IdentLuhn}, "card 4111111111111111 4111111111111112",
+			"card 4111111111111111 4,111,111,111,111,112"},
+		{Options{Identifiers: IdentISBN}, "isbn 9780306406157 8175257660 9780306406158",
+			"isbn 9780306406157 8175257660 9,780,306,406,158"},
+		{Options{Identifiers: IdentAll}, "4111111111111111.5", "4,111,111,111,111,111.5"},
+		// short hex hashes that end in a hex letter unit
+		{Options{}, "commit 1234567d fix", "commit 1,234,567d fix"},
+		{Options{Identifiers: IdentHex}, "commit 1234567d fix 9876543B 12345d 1048576KB 1234567ms",
+			"commit 1234567d fix 9876543B 12,345d 1,048,576KB 1,234,567ms"},
+		{
+			Options{},
+			"sha 5d41402abc4b2a76b9719d911017c592 uuid 12345678-1234-5678-1234-567812345678",
+			"sha 5d41402abc4b2a76b9719d911017c592 uuid 12345678-1234-5678-1234-567812345678",
+		},
+	}
+	for _, x := range tests {
+		num := New()
+		num.SetOptions(x.opts)
+		num.Write([]byte(x.in))
+		num.Flush()
+		if out := num.buf.String(); out != x.out {
+			t.Errorf("Num (%+v): %q\n\tgot:  %q\n\twant: %q", x.opts, x.in, out, x.out)
+		}
+	}
+}
+
+func TestUnits(t *testing.T) {
+	tests := []struct {
+		units []string
+		in    string
+		out   string
+	}{
+		{
+			nil,
+			"123456789ns 1048576B 2400000000Hz 1536KiB 12345µs 1234567.5ms 4096B/op",
+			"123,456,789ns 1,048,576B 2,400,000,000Hz 1,536KiB 12,345µs 1,234,567.5ms 4,096B/op",
+		},
+		{nil, "abc123456 123456abc 123456ns1 123456ns/ 123456.ms", "abc123456 123456abc 123456ns1 123456ns/ 123456.ms"},
+		{nil, "0x123456 0123456ns", "0x123456 0123456ns"},
+		{[]string{}, "123456789ns 123456789", "123456789ns 123,456,789"},
+		{[]string{"rows"}, "123456rows 123456ns", "123,456rows 123456ns"},
+	}
+	for _, x := range tests {
+		num := New()
+		num.SetOptions(Options{Units: x.units})
+		num.Write([]byte(x.in))
+		num.Flush()
+		if out := num.buf.String(); out != x.out {
+			t.Errorf("Num (%q): %q\n\tgot:  %q\n\twant: %q", x.units, x.in, out, x.out)
+		}
+	}
+}
+
+func TestCurrency(t *testing.T) {
+	tests := []testCase{
+		{"$1234567.89 €1234567 £1234 ¥1234567", "$1,234,567.89 €1,234,567 £1,234 ¥1,234,567"},
+		{"USD1234567 1234567USD 1234567€ US$1234567", "USD1,234,567 1,234,567USD 1,234,567€ US$1,234,567"},
+		{"-$1234567 $-1234567 -€1234.5", "-$1,234,567 $-1,234,567 -€1,234.5"},
+		{"(1234567) ($1234567.89) (-1234567) (1234567), (1234567).", "(1,234,567) ($1,234,567.89) (-1,234,567) (1,234,567), (1,234,567)."},
+		{"((1234567)) (1234567 rows) f(1234567)", "((1,234,567)) (1,234,567 rows) f(1234567)"},
+		{"1234567% 1234567‰ (1234567%) 50%", "1,234,567% 1,234,567‰ (1,234,567%) 50%"},
+		{"ABC123456 XYZ1234 Hello 123456abc (123456)abc", "ABC123456 XYZ1234 Hello 123456abc (123456)abc"},
+		{"- -- $ $- ( () USD", "- -- $ $- ( () USD"},
+		{"paid $1234567.89, then $1234567, then $1234567.89.", "paid $1,234,567.89, then $1,234,567, then $1,234,567.89."},
+		{"€1234567.5; $1234567.89! -$1234567.89? (€1234.5),", "€1,234,567.5; $1,234,567.89! -$1,234,567.89? (€1,234.5),"},
+		{"v1234.5678.9 1234.5678.9 1234567.89.x", "v1234.5678.9 1234.5678.9 1234567.89.x"},
+	}
+	for _, x := range tests {
+		num := New()
+		num.Write([]byte(x.In))
+		num.Flush()
+		if out := num.buf.String(); out != x.Out {
+			t.Errorf("Num: %q\n\tgot:  %q\n\twant: %q", x.In, out, x.Out)
+		}
+	}
+}
+
+func TestFormatCurrency(t *testing.T) {
+	tests := []struct {
+		amount float64
+		code   string
+		want   string
+	}{
+		{1234567.891, "USD", "USD 1,234,567.89"},
+		{-1234567.891, "EUR", "EUR -1,234,567.89"},
+		{1234567.891, "JPY", "JPY 1,234,568"},
+		{1234.5678, "KWD", "KWD 1,234.568"},
+		{12.5, "CLF", "CLF 12.5000"},
+	}
+	for _, x := range tests {
+		got, err := FormatCurrency(x.amount, x.code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != x.want {
+			t.Errorf("FormatCurrency(%f, %q) = %q; want: %q", x.amount, x.code, got, x.want)
+		}
+	}
+	if _, err := FormatCurrency(1, "XXX"); err == nil {
+		t.Error("FormatCurrency: expected error for unknown currency code")
+	}
+}
+
+func TestGrouped(t *testing.T) {
+	tests := []struct {
+		regroup bool
+		in      string
+		out     string
+	}{
+		{false, "1,234,567 1234,567 12,34,567 1,234.5678", "1,234,567 1,234,567 12,34,567 1,234.5678"},
+		{false, "1234567,890.5 $1234,567 1,2,3 1234,5678", "1,234,567,890.5 $1,234,567 1,2,3 1234,5678"},
+		{true, "1,234,567 1234,567 1234567,890.5 $1234,567", "1,234,567 1,234,567 1,234,567,890.5 $1,234,567"},
+		{true, "12,34,567 1,23,45,678.9 -1,00,000", "1,234,567 12,345,678.9 -100,000"},
+		{true, "1,2,3 123,45,678 12,34,5678 1234,5678 0,5", "1,2,3 123,45,678 12,34,5678 1234,5678 0,5"},
+		{false, "1234, 5678, and 1234567,", "1,234, 5,678, and 1,234,567,"},
+		{false, "1234,abc (1234567), 1234567ms, 1234567ms.", "1234,abc (1,234,567), 1,234,567ms, 1,234,567ms."},
+		{false, "1234567; 1234567.5, 1,234,567.5. 1234567.", "1,234,567; 1,234,567.5, 1,234,567.5. 1,234,567."},
+		{true, "1234,567.89; 1234,567.", "1,234,567.89; 1,234,567."},
+	}
+	for _, x := range tests {
+		var buf bytes.Buffer
+		enc := NewEncoder(&buf)
+		enc.SetOptions(Options{Regroup: x.regroup})
+		if err := enc.Encode(bytes.NewReader([]byte(x.in))); err != nil {
+			t.Fatal(err)
+		}
+		if out := buf.String(); out != x.out {
+			t.Errorf("Encoder (regroup: %t): %q\n\tgot:  %q\n\twant: %q", x.regroup, x.in, out, x.out)
+		}
+
+		// formatting must be idempotent
+		in := buf.String()
+		buf.Reset()
+		enc = NewEncoder(&buf)
+		enc.SetOptions(Options{Regroup: x.regroup})
+		if err := enc.Encode(bytes.NewReader([]byte(in))); err != nil {
+			t.Fatal(err)
+		}
+		if out := buf.String(); out != in {
+			t.Errorf("Encoder (regroup: %t): not idempotent: %q\n\tgot:  %q\n\twant: %q", x.regroup, x.in, out, in)
+		}
+	}
+}
+
+func TestQuotes(t *testing.T) {
+	tests := []struct {
+		mode QuoteMode
+		in   string
+		out  string
+	}{
+		{QuoteNone, `{"id": "1234567", "n": 1234567}`, `{"id": "1,234,567", "n": 1,234,567}`},
+		{QuoteSkip, `{"id": "1234567", "n": 1234567}`, `{"id": "1234567", "n": 1,234,567}`},
+		{QuoteFormat, `{"id": "1234567", "n": 1234567}`, `{"id": "1,234,567", "n": 1,234,567}`},
+		{QuoteSkip, `"a \" 1234567" 1234567`, `"a \" 1234567" 1,234,567`},
+		{QuoteSkip, `'it''s 1234567' 1234567`, `'it''s 1234567' 1,234,567`},
+		{QuoteSkip, `it's 1234567 'a 1234567'`, `it's 1,234,567 'a 1234567'`},
+		{QuoteSkip, "'unterminated 1234567\n1234567", "'unterminated 1234567\n1,234,567"},
+		{QuoteSkip, `"1234567"1234567 ""1234567`, `"1234567"1,234,567 ""1,234,567`},
+		{QuoteFormat, `"a \" 1234567" 'it''s 1234567'`, `"a \" 1,234,567" 'it''s 1,234,567'`},
+		{QuoteFormat, `"abc\"1234567 x" 1234567`, `"abc\"1234567 x" 1,234,567`},
+		{QuoteFormat, `'1234567''1234567'`, `'1,234,567''1,234,567'`},
+	}
+	for _, x := range tests {
+		num := New()
+		num.SetOptions(Options{Quotes: x.mode})
+		num.Write([]byte(x.in))
+		num.Flush()
+		if out := num.buf.String(); out != x.out {
+			t.Errorf("Num (mode: %d): %q\n\tgot:  %q\n\twant: %q", x.mode, x.in, out, x.out)
+		}
+	}
+}
+
+func TestMaxTokenLen(t *testing.T) {
+	tests := map[string]string{
+		"1234567 123456789 1234567": "1,234,567 123456789 1,234,567",
+		"$1234567 $12345678":        "$1,234,567 $12345678",
+		"(12345678) 12345ms":        "(12345678) 12,345ms",
+		"123456789x 1234567":        "123456789x 1,234,567",
+	}
+	for in, want := range tests {
+		for size := 1; size <= len(in); size++ {
+			n := New()
+			n.SetOptions(Options{MaxTokenLen: 8})
+			writeChunked(n, []byte(in), size, nil)
+			n.Flush()
+			if out := n.buf.String(); out != want {
+				t.Errorf("Num (size: %d): %q\n\tgot:  %q\n\twant: %q", size, in, out, want)
+			}
+		}
+	}
+
+	// The pending number buffer must not grow with the length of a run
+	// of digits.
+	n := New()
+	chunk := bytes.Repeat([]byte("1234567890"), 1024)
+	var out bytes.Buffer
+	for i := 0; i < 1024; i++ {
+		n.Write(chunk)
+		n.WriteTo(&out)
+		if len(n.lex.partial) > DefaultMaxTokenLen {
+			t.Fatalf("pending number buffer: got %d bytes want at most: %d",
+				len(n.lex.partial), DefaultMaxTokenLen)
+		}
+	}
+	n.Write([]byte(" 1234567"))
+	n.Flush()
+	n.WriteTo(&out)
+	want := strings.Repeat(string(chunk), 1024) + " 1,234,567"
+	if out.String() != want {
+		t.Errorf("Num: digit run was not passed through verbatim")
+	}
+}
+
+func TestUnicodeSpace(t *testing.T) {
+	tests := map[string]string{
+		"1234567\u00a0x":           "1,234,567\u00a0x",
+		"x\u00a01234567":           "x\u00a01,234,567",
+		"\u20091234567\u2009":      "\u20091,234,567\u2009",
+		"\u30001234567\u3000":      "\u30001,234,567\u3000",
+		"1234567\u0085":            "1,234,567\u0085",
+		"1234567\u1680":            "1,234,567\u1680",
+		"1234567\u2028":            "1,234,567\u2028",
+		"1234567\u202f":            "1,234,567\u202f",
+		"1234567\u205f":            "1,234,567\u205f",
+		"1234567\v1234567\f":       "1,234,567\v1,234,567\f",
+		"(1234567)\u00a0-1234567%": "(1,234,567)\u00a0-1,234,567%",
+		"€1234567 1234567€":        "€1,234,567 1,234,567€",
+		"1234567µs 1234567‰":       "1,234,567µs 1,234,567‰",
+		"$\u00a01234567":           "$\u00a01,234,567",
+		"1234567\u00a1":            "1234567\u00a1",
+		"1234567\xe2\x80":          "1234567\xe2\x80",
+		"1234567\xe2\x80 1234567":  "1234567\xe2\x80 1,234,567",
+	}
+	for in, want := range tests {
+		for _, opts := range []Options{{}, {Markers: Markers{Off: "num:off", On: "num:on"}}} {
+			for size := 1; size <= len(in); size++ {
+				n := New()
+				n.SetOptions(opts)
+				writeChunked(n, []byte(in), size, nil)
+				n.Flush()
+				if out := n.buf.String(); out != want {
+					t.Errorf("Num (size: %d, markers: %t): %q\n\tgot:  %q\n\twant: %q",
+						size, opts.Markers.enabled(), in, out, want)
+				}
+			}
+		}
+	}
+}
+
+func TestMarkers(t *testing.T) {
+	tests := []struct {
+		markers Markers
+		in      string
+		out     string
+	}{
+		{
+			Markers{Off: "num:off", On: "num:on"},
+			"1234567 num:off 1234567 num:on 1234567",
+			"1,234,567 num:off 1234567 num:on 1,234,567",
+		},
+		{
+			Markers{Off: "num:off", On: "num:on", Strip: true},
+			"1234567 num:off 1234567 num:on 1234567",
+			"1,234,567  1234567  1,234,567",
+		},
+		{
+			Markers{Off: "num:off", On: "num:on", Strip: true},
+			"1234567num:off1234567num:on1234567 num:o 1234567 num:",
+			"1,234,56712345671,234,567 num:o 1,234,567 num:",
+		},
+		{
+			Markers{Off: "aab", On: "bba", Strip: true},
+			"aaab 1234567 bbba 1234567 aa",
+			"a 1234567 b 1,234,567 aa",
+		},
+		{
+			Markers{Off: "num:off"}, // disabled
+			"num:off 1234567",
+			"num:off 1,234,567",
+		},
+	}
+	for _, x := range tests {
+		for _, size := range []int{1, 2, 3, len(x.in)} {
+			num := New()
+			num.SetOptions(Options{Markers: x.markers})
+			writeChunked(num, []byte(x.in), size, nil)
+			num.Flush()
+			if out := num.buf.String(); out != x.out {
+				t.Errorf("Num (%+v, size: %d): %q\n\tgot:  %q\n\twant: %q",
+					x.markers, size, x.in, out, x.out)
+			}
+		}
+	}
+}
+
+func TestLuhnValid(t *testing.T) {
+	tests := map[string]bool{
+		"4111111111111111": true,
+		"4111111111111112": false,
+		"5500005555555559": true,
+		"79927398713":      true,
+		"79927398710":      false,
+	}
+	for s, want := range tests {
+		if got := luhnValid([]byte(s)); got != want {
+			t.Errorf("luhnValid(%q) = %t; want: %t", s, got, want)
+		}
+	}
+}
+
+// failOn returns a copy of the scanner table without quote handling that
+// fails on byte c, and all other bytes of its class, in every state.
+func failOn(c byte) *scanTable {
+	tab := scanTables[QuoteNone]
+	for st := 0; st < numStates; st++ {
+		tab[st*classStride+int(byteClass[c])] = stError | scanError<<8
+	}
+	return &tab
+}
+
+// Test that all bytes of a class have the same transitions, by comparing the
+// generated tables with the transition rules evaluated for every byte.
+func TestScannerTable(t *testing.T) {
+	for mode := range scanTables {
+		g := generator{mode: QuoteMode(mode)}
+		for st := 0; st < numStates; st++ {
+			for c := 0; c < 256; c++ {
+				next, code := g.next(st%numBaseStates, st/numBaseStates, c)
+				want := transition(next) | transition(code)<<8
+				got := scanTables[mode][st*classStride+int(byteClass[c])]
+				if got != want {
+					t.Errorf("mode %d: state %d: byte %q: got transition %#x want: %#x",
+						mode, st, c, got, want)
+				}
+			}
+		}
+	}
+}
+
+// Test that skipping digit-free spans does not change the output.
+func TestFastPath(t *testing.T) {
+	inputs := []string{
+		"abc 123 def",
+		"$ 5 USD 10",
+		"[[[[5 ((((6",
+		"x\ty 12,345\r\nfoo-bar -7 (8) 9ms;",
+		"no digits at all in this text",
+		"word\x00word 1234567 tail",
+		string(logdata[:4096]),
+		string(testdata[:64*1024]),
+	}
+	tab := scanTables[QuoteNone] // a copy disables the fast path
+	for _, in := range inputs {
+		for _, size := range []int{1, 3, 7, 64, len(in)} {
+			fast, slow := New(), New()
+			slow.init()
+			slow.lex.scan.tab = &tab
+			writeChunked(fast, []byte(in), size, nil)
+			writeChunked(slow, []byte(in), size, nil)
+			fast.Flush()
+			slow.Flush()
+			if fast.buf.String() != slow.buf.String() {
+				t.Errorf("%.40q: size %d: got %.80q want: %.80q",
+					in, size, fast.buf.String(), slow.buf.String())
+			}
+		}
+	}
+}
+
+func TestIndexDigit(t *testing.T) {
+	tests := map[string]int{
+		"":                                  -1,
+		"abc":                               -1,
+		"abcdefghijklmnop":                  -1,
+		"/:/:/:/:/:/:/:/:/:":                -1,
+		"0":                                 0,
+		"abcdefgh9":                         8,
+		"abcdefghijklmn5op":                 14,
+		"\xff\xff\xff\xff\xff\xff\xff\xff1": 8,
+	}
+	for s, want := range tests {
+		if got := indexDigit([]byte(s)); got != want {
+			t.Errorf("indexDigit(%q) = %d; want: %d", s, got, want)
+		}
+	}
+	for c := 0; c < 256; c++ {
+		b := []byte("abcdefghijklmnop")
+		b[11] = byte(c)
+		want := -1
+		if isDigit(byte(c)) {
+			want = 11
+		}
+		if got := indexDigit(b); got != want {
+			t.Errorf("indexDigit(%q) = %d; want: %d", b, got, want)
+		}
+	}
+}
+
+func TestScannerError(t *testing.T) {
+	n := New()
+	n.Write([]byte("1234\n567 "))
+	n.Flush()
+	n.Write([]byte("x"))
+	n.lex.scan.tab = failOn('!')
+	_, err := n.Write([]byte("ab\ncd!ef"))
+	if !errors.Is(err, ErrInvalidState) {
+		t.Fatalf("errors.Is(%v, ErrInvalidState) = false", err)
+	}
+	var se *ScannerError
+	if !errors.As(err, &se) {
+		t.Fatalf("errors.As(%v, *ScannerError) = false", err)
+	}
+	want := ScannerError{
+		Err:     ErrInvalidState,
+		Offset:  15,
+		Line:    3,
+		Column:  3,
+		Byte:    '!',
+		Snippet: "ab\ncd!ef",
+	}
+	if *se != want {
+		t.Errorf("ScannerError:\n\tgot:  %+v\n\twant: %+v", *se, want)
+	}
+	if se.Bytes() != 16 {
+		t.Errorf("ScannerError.Bytes() = %d; want: %d", se.Bytes(), 16)
+	}
+}
+
+type namedReader struct {
+	*strings.Reader
+	name string
+}
+
+func (r *namedReader) Name() string { return r.name }
+
+func TestEncoderScannerError(t *testing.T) {
+	enc := NewEncoder(new(NopWriter))
+	enc.n.init()
+	enc.n.lex.scan.tab = failOn('!')
+	err := enc.Encode(&namedReader{strings.NewReader("abc!"), "input.txt"})
+	if err == nil || !strings.HasPrefix(err.Error(), "input.txt: num: invalid parse state") {
+		t.Errorf("Encode: got error %v want prefix %q", err, "input.txt: num: invalid parse state")
+	}
+	var se *ScannerError
+	if !errors.As(err, &se) || se.Offset != 3 {
+		t.Errorf("Encode: expected *ScannerError at offset 3 got: %#v", err)
+	}
+}
+
+func TestStats(t *testing.T) {
+	const in = "a 1234567 007 1,234 123 12345678901 x"
+	n := New()
+	n.SetOptions(Options{MaxTokenLen: 10})
+	n.Write([]byte(in[:6]))
+	n.Write([]byte(in[6:]))
+	n.Flush()
+	want := Stats{
+		BytesIn:        int64(len(in)),
+		BytesOut:       int64(len(in) + 2),
+		Numbers:        4,
+		Grouped:        1,
+		SkippedIdent:   1,
+		SkippedGrouped: 1,
+		SkippedLong:    1,
+		MaxLen:         7,
+		Carries:        1,
+	}
+	if got := n.Stats(); got != want {
+		t.Errorf("Stats:\n\tgot:  %+v\n\twant: %+v", got, want)
+	}
+	n.Reset()
+	if got := n.Stats(); got != (Stats{}) {
+		t.Errorf("Stats after Reset: got %+v", got)
+	}
+
+	enc := NewEncoder(new(NopWriter))
+	if err := enc.Encode(iotest.OneByteReader(strings.NewReader("1234567 12"))); err != nil {
+		t.Fatal(err)
+	}
+	if got := enc.Stats(); got.Numbers != 2 || got.Grouped != 1 || got.BytesOut != 12 {
+		t.Errorf("Encoder.Stats: got %+v", got)
+	}
+}
+
+func TestStatsAdd(t *testing.T) {
+	s := Stats{BytesIn: 1, Numbers: 2, Replaced: 3, MaxLen: 7, Carries: 1}
+	s.Add(Stats{BytesIn: 10, Numbers: 20, Replaced: 30, MaxLen: 4, SkippedLong: 5})
+	want := Stats{BytesIn: 11, Numbers: 22, Replaced: 33, MaxLen: 7, SkippedLong: 5, Carries: 1}
+	if s != want {
+		t.Errorf("Add: got %+v want: %+v", s, want)
+	}
+}
+
+func TestReplace(t *testing.T) {
+	type call struct {
+		Raw, Int, Frac string
+		Neg            bool
+		Offset         int64
+	}
+	var calls []call
+	replace := func(dst []byte, t *Token) ([]byte, bool) {
+		calls = append(calls, call{
+			Raw:    string(t.Raw),
+			Int:    string(t.Raw[t.Int.Start:t.Int.End]),
+			Frac:   string(t.Raw[t.Frac.Start:t.Frac.End]),
+			Neg:    t.Neg,
+			Offset: t.Offset,
+		})
+		switch {
+		case bytes.HasSuffix(t.Raw, []byte("B")):
+			// convert bytes to MiB
+			v, err := strconv.ParseInt(string(t.Raw[t.Int.Start:t.Int.End]), 10, 64)
+			if err != nil {
+				return dst, false
+			}
+			return append(dst, FormatFloat(float64(v)/(1<<20), 'f', 1, 64)+"MiB"...), true
+		case t.Neg:
+			return append(dst, "<redacted>"...), true
+		}
+		return dst, false
+	}
+	const in = "size 10485760B delta -1234.5 count 1234567 id 007"
+	const want = "size 10.0MiB delta <redacted> count 1,234,567 id 007"
+	n := New()
+	n.SetOptions(Options{Replace: replace})
+	for i := 0; i < len(in); i++ {
+		n.Write([]byte{in[i]})
+	}
+	n.Flush()
+	if out := n.buf.String(); out != want {
+		t.Errorf("Replace: got %q want: %q", out, want)
+	}
+	wantCalls := []call{
+		{Raw: "10485760B", Int: "10485760", Offset: 5},
+		{Raw: "-1234.5", Int: "1234", Frac: "5", Neg: true, Offset: 21},
+		{Raw: "1234567", Int: "1234567", Offset: 35},
+		{Raw: "007", Int: "007", Offset: 46},
+	}
+	if len(calls) != len(wantCalls) {
+		t.Fatalf("Replace: got calls %+v want: %+v", calls, wantCalls)
+	}
+	for i := range calls {
+		if calls[i] != wantCalls[i] {
+			t.Errorf("Replace: call %d: got %+v want: %+v", i, calls[i], wantCalls[i])
+		}
+	}
+	if got := n.Stats().Replaced; got != 2 {
+		t.Errorf("Stats.Replaced: got %d want: %d", got, 2)
+	}
+}
+
 func TestFormatInt(t *testing.T) {
 	const MaxInt64 = 1<<63 - 1
 	const MinInt64 = -1 << 63
@@ -198,6 +989,70 @@ func TestFormat(t *testing.T) {
 	}
 }
 
+func TestFormatText(t *testing.T) {
+	tests := []struct {
+		in, out string
+	}{
+		{"", ""},
+		{"no numbers", "no numbers"},
+		{"1234567", "1,234,567"},
+		{"processed 1234567 rows in 9876 ms", "processed 1,234,567 rows in 9,876 ms"},
+		{"id abc1234567 -1234.5678 $1234 (1234)", "id abc1234567 -1,234.5678 $1,234 (1,234)"},
+		{"small 1 2 3", "small 1 2 3"},
+		{"already 1,234,567", "already 1,234,567"},
+	}
+	for _, x := range tests {
+		if s := FormatText(x.in); s != x.out {
+			t.Errorf("FormatText(%q): got %q want: %q", x.in, s, x.out)
+		}
+		dst := []byte("> ")
+		if b := AppendText(dst, []byte(x.in)); string(b) != "> "+x.out {
+			t.Errorf("AppendText(%q): got %q want: %q", x.in, b, "> "+x.out)
+		}
+	}
+	if s, want := FormatText(string(testdata)), testdataFormatted(t); s != want {
+		t.Error("FormatText(testdata): output differs from Num")
+	}
+}
+
+func testdataFormatted(t *testing.T) string {
+	n := New()
+	n.Write(testdata)
+	n.Flush()
+	return n.buf.String()
+}
+
+func TestFormatTextAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("sync.Pool drops items under the race detector")
+	}
+	src := []byte("processed 1234567 rows in 9876 ms")
+	dst := make([]byte, 0, 64)
+	tests := []struct {
+		name string
+		fn   func()
+		want float64
+	}{
+		{"AppendText", func() { dst = AppendText(dst[:0], src) }, 0},
+		{"FormatText", func() { FormatText("processed 1234567 rows") }, 1},
+		{"FormatText unchanged", func() { FormatText("processed 123 rows") }, 0},
+	}
+	for _, x := range tests {
+		if n := testing.AllocsPerRun(100, x.fn); n > x.want {
+			t.Errorf("%s: got %v allocs want: %v", x.name, n, x.want)
+		}
+	}
+}
+
+func BenchmarkAppendText(b *testing.B) {
+	src := []byte("processed 1234567 rows in 9876 ms")
+	dst := make([]byte, 0, 64)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		dst = AppendText(dst[:0], src)
+	}
+}
+
 func TestFormatNumber(t *testing.T) {
 	var b []byte
 	for _, x := range expandTests {
@@ -215,6 +1070,9 @@ func TestFormatFloat(t *testing.T) {
 		want string
 	}{
 		{1_234_567.123456, "1,234,567.123456"},
+		{-123_456.5, "-123,456.5"},
+		{1_234_567, "1,234,567"},
+		{123, "123"},
 	}
 	for _, x := range tests {
 		got := FormatFloat(x.f, 'f', -1, 64)
@@ -263,25 +1121,30 @@ func BenchmarkNum(b *testing.B) {
 }
 
 func BenchmarkNumStream(b *testing.B) {
-	p := testdata
-	size := bytes.MinRead
-	w := &NopWriter{}
-	b.ResetTimer()
 	n := New()
 	for j := 0; j < b.N; j++ {
-		var i int
-		for i = 0; i < len(p)-size; i += size {
-			n.Write(p[i : i+size])
-			n.WriteTo(w)
-		}
-		if i < len(p) {
-			n.Write(p[i:])
-			n.WriteTo(w)
-		}
+		writeStream(n, bytes.MinRead, testdata)
 		n.Reset()
 	}
 }
 
+// Write the testdata in chunks, as read from a file or pipe, so that many
+// numbers straddle writes.
+func BenchmarkNumChunks(b *testing.B) {
+	for _, size := range []int{512, 4096, 32 * 1024} {
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			n := New()
+			b.SetBytes(int64(len(testdata)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				writeStream(n, size, testdata)
+				n.Reset()
+			}
+		})
+	}
+}
+
 func BenchmarkStream(b *testing.B) {
 	w := &NopWriter{}
 	r := bytes.NewReader(testdata)
@@ -294,16 +1157,57 @@ func BenchmarkStream(b *testing.B) {
 	}
 }
 
+// logdata is log text in which most lines have no numbers.
+var logdata = bytes.Repeat([]byte(
+	"INFO server: handled request method=GET path=/api/users status=ok\n"+
+		"DEBUG cache: lookup key=session:abcdef hit=true\n"+
+		"WARN pool: connection reset by peer, retrying request\n"+
+		"INFO server: request completed in 1234567us bytes=65536\n"), 8192)
+
+func BenchmarkNumLog(b *testing.B) {
+	n := New()
+	b.SetBytes(int64(len(logdata)))
+	for i := 0; i < b.N; i++ {
+		n.Write(logdata)
+		n.Reset()
+	}
+}
+
+// Scanning without the fast path, for comparison with BenchmarkNumLog.
+func BenchmarkNumLogSlow(b *testing.B) {
+	n := New()
+	n.init()
+	tab := scanTables[QuoteNone] // a copy disables the fast path
+	n.lex.scan.tab = &tab
+	b.SetBytes(int64(len(logdata)))
+	for i := 0; i < b.N; i++ {
+		n.Write(logdata)
+		n.Reset()
+	}
+}
+
+// writeStream, writes p to n in size-byte pieces, as read from a file or
+// pipe, and discards the output after each piece.
 func writeStream(n *Num, size int, p []byte) {
 	w := &NopWriter{}
-	var i int
-	for i = 0; i < len(p)-size; i += size {
-		n.Write(p[i : i+size])
-		n.WriteTo(w)
-	}
-	if i < len(p) {
-		n.Write(p[i:])
-		n.WriteTo(w)
+	writeChunked(n, p, size, w)
+	n.Flush()
+	n.WriteTo(w)
+}
+
+// writeChunked, writes p to n in size-byte pieces.  If w is not nil the
+// output is written to w after each piece.
+func writeChunked(n *Num, p []byte, size int, w io.Writer) {
+	for len(p) != 0 {
+		k := size
+		if k > len(p) {
+			k = len(p)
+		}
+		n.Write(p[:k])
+		if w != nil {
+			n.WriteTo(w)
+		}
+		p = p[k:]
 	}
 }
 
@@ -313,18 +1217,23 @@ func (n *NopWriter) Write(p []byte) (int, error) {
 	return len(p), nil
 }
 
+// nopTokens is a tokenWriter that discards all tokens.
+type nopTokens struct{}
+
+func (nopTokens) writeToken(t *Token)   {}
+func (nopTokens) stripped(offset int64) {}
+
+// Benchmark the scanner loop of the lexer, including parsing the numbers
+// but not formatting them.
 func BenchmarkScanner(b *testing.B) {
-	src := testdata
-	scan := newScanner()
+	l := lexer{scan: newScanner()}
+	l.init()
+	b.SetBytes(int64(len(testdata)))
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		scan.reset()
-		for _, c := range src {
-			scan.bytes++
-			switch scan.step(scan, int(c)) {
-			case scanError:
-				b.Fatal(scan.err)
-			}
+		l.reset()
+		if _, err := l.scanBytes(testdata, 0, len(testdata), 0, nopTokens{}, true); err != nil {
+			b.Fatal(err)
 		}
 	}
 }
@@ -0,0 +1,74 @@
+package num
+
+import "sort"
+
+// An OffsetMap maps byte offsets between the input and the output of a Num
+// or Encoder, see Options.Offsets.  It holds one Segment for every number
+// whose formatted length differs from its length in the input, and one for
+// every marker removed by Markers.Strip.
+//
+// Offsets outside of changed numbers and stripped markers are mapped
+// exactly.  An offset inside a changed number is mapped to the same
+// distance from the start of the number, limited to the end of the number.
+// An offset inside a stripped marker is mapped to the byte before it, or
+// to zero at the start of the output.
+type OffsetMap struct {
+	segs []Segment
+}
+
+// A Segment records the end of a changed number or stripped marker: the
+// input and output offsets of the byte after it, and the difference
+// between them, which applies to all offsets up to the next Segment.
+type Segment struct {
+	In    int64
+	Out   int64
+	Delta int64 // Out - In
+}
+
+// Segments, returns the segments of the map in increasing order.  The
+// returned slice must not be modified.
+func (m *OffsetMap) Segments() []Segment {
+	return m.segs
+}
+
+// Reset, removes all segments from the map.
+func (m *OffsetMap) Reset() {
+	m.segs = m.segs[:0]
+}
+
+func (m *OffsetMap) add(in, out int64) {
+	m.segs = append(m.segs, Segment{In: in, Out: out, Delta: out - in})
+}
+
+// Output, returns the output offset of input offset in.
+func (m *OffsetMap) Output(in int64) int64 {
+	// i is the index of the first segment after in
+	i := sort.Search(len(m.segs), func(i int) bool { return m.segs[i].In > in })
+	var delta int64
+	if i > 0 {
+		delta = m.segs[i-1].Delta
+	}
+	out := in + delta
+	if i < len(m.segs) && out >= m.segs[i].Out {
+		// inside the number or marker
+		out = m.segs[i].Out - 1
+		if out < 0 {
+			out = 0 // a marker at the start of the input
+		}
+	}
+	return out
+}
+
+// Input, returns the input offset of output offset out.
+func (m *OffsetMap) Input(out int64) int64 {
+	i := sort.Search(len(m.segs), func(i int) bool { return m.segs[i].Out > out })
+	var delta int64
+	if i > 0 {
+		delta = m.segs[i-1].Delta
+	}
+	in := out - delta
+	if i < len(m.segs) && in >= m.segs[i].In {
+		in = m.segs[i].In - 1 // inside the number
+	}
+	return in
+}
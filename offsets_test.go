@@ -0,0 +1,131 @@
+package num
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestOffsetMap(t *testing.T) {
+	const in = "a 1234567 b 12 c 1234,567 d"
+	const out = "a 1,234,567 b 12 c 1,234,567 d"
+	n := New()
+	n.SetOptions(Options{Offsets: true, Regroup: true})
+	writeChunked(n, []byte(in), 3, nil)
+	n.Flush()
+	if s := n.buf.String(); s != out {
+		t.Fatalf("Num: got %q want: %q", s, out)
+	}
+	m := n.Offsets()
+	want := []Segment{{In: 9, Out: 11, Delta: 2}, {In: 25, Out: 28, Delta: 3}}
+	segs := m.Segments()
+	if len(segs) != len(want) {
+		t.Fatalf("Segments: got %+v want: %+v", segs, want)
+	}
+	for i := range segs {
+		if segs[i] != want[i] {
+			t.Errorf("Segments: %d: got %+v want: %+v", i, segs[i], want[i])
+		}
+	}
+
+	// Offsets outside of changed numbers map exactly in both directions.
+	for _, w := range []string{"a", "b", "12", "c", "d"} {
+		i := int64(strings.Index(in, " "+w+" ")) + 1
+		if w == "a" {
+			i = 0
+		}
+		o := int64(strings.Index(out, " "+w+" ")) + 1
+		if w == "a" {
+			o = 0
+		}
+		if w == "d" {
+			i, o = int64(len(in)-1), int64(len(out)-1)
+		}
+		if got := m.Output(i); got != o {
+			t.Errorf("Output(%d) (%q): got %d want: %d", i, w, got, o)
+		}
+		if got := m.Input(o); got != i {
+			t.Errorf("Input(%d) (%q): got %d want: %d", o, w, got, i)
+		}
+	}
+
+	// Offsets inside a changed number stay inside the number.
+	for i := int64(2); i < 9; i++ {
+		if o := m.Output(i); o < 2 || o >= 11 {
+			t.Errorf("Output(%d): got %d want offset in [2, 11)", i, o)
+		}
+	}
+	for o := int64(2); o < 11; o++ {
+		if i := m.Input(o); i < 2 || i >= 9 {
+			t.Errorf("Input(%d): got %d want offset in [2, 9)", o, i)
+		}
+	}
+
+	n.Reset()
+	if segs := n.Offsets().Segments(); len(segs) != 0 {
+		t.Errorf("Segments after Reset: got %+v", segs)
+	}
+}
+
+func TestOffsetMapStrip(t *testing.T) {
+	const in = "a <off>x<on> 1234567 b <off><on>c"
+	const out = "a x 1,234,567 b c"
+	n := New()
+	n.SetOptions(Options{
+		Offsets: true,
+		Markers: Markers{Off: "<off>", On: "<on>", Strip: true},
+	})
+	for i := 0; i < len(in); i++ {
+		n.Write([]byte{in[i]})
+	}
+	n.Flush()
+	if s := n.buf.String(); s != out {
+		t.Fatalf("Num: got %q want: %q", s, out)
+	}
+	m := n.Offsets()
+	want := []Segment{
+		{In: 7, Out: 2, Delta: -5},
+		{In: 12, Out: 3, Delta: -9},
+		{In: 20, Out: 13, Delta: -7},
+		{In: 28, Out: 16, Delta: -12},
+		{In: 32, Out: 16, Delta: -16},
+	}
+	segs := m.Segments()
+	if len(segs) != len(want) {
+		t.Fatalf("Segments: got %+v want: %+v", segs, want)
+	}
+	for i := range segs {
+		if segs[i] != want[i] {
+			t.Errorf("Segments: %d: got %+v want: %+v", i, segs[i], want[i])
+		}
+	}
+
+	// Bytes that are not stripped or changed map exactly.
+	tests := []struct {
+		in, out int64
+	}{
+		{0, 0}, {1, 1}, {7, 2}, {12, 3}, {20, 13}, {21, 14}, {22, 15}, {32, 16},
+	}
+	for _, x := range tests {
+		if got := m.Output(x.in); got != x.out {
+			t.Errorf("Output(%d) (%q): got %d want: %d", x.in, in[x.in], got, x.out)
+		}
+		if got := m.Input(x.out); got != x.in {
+			t.Errorf("Input(%d) (%q): got %d want: %d", x.out, out[x.out], got, x.in)
+		}
+	}
+
+	// Offsets inside a stripped marker map to the byte before it.
+	for _, x := range []struct{ in, out int64 }{{2, 1}, {6, 1}, {8, 2}, {11, 2}, {24, 15}, {30, 15}} {
+		if got := m.Output(x.in); got != x.out {
+			t.Errorf("Output(%d): got %d want: %d", x.in, got, x.out)
+		}
+	}
+
+	// A marker at the start of the input maps to the first byte.
+	n.Reset()
+	n.Write([]byte("<off>1234<on>"))
+	n.Flush()
+	if got := n.Offsets().Output(2); got != 0 {
+		t.Errorf("Output(2): got %d want: 0", got)
+	}
+}
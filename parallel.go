@@ -0,0 +1,296 @@
+package num
+
+import (
+	"bytes"
+	"io"
+	"runtime"
+	"sync"
+)
+
+// A ParallelEncoder is an Encoder for large inputs, such as multi-gigabyte
+// logs, that formats chunks of the input on multiple goroutines and writes
+// the results in their original order.  Its output is identical to that
+// of an Encoder with the same options.
+//
+// The input is split at bytes after which the scanner is always in its
+// initial state: ASCII spaces or, if quoted strings are tracked, newlines
+// that do not follow a backslash.  If there is no such byte within a few
+// chunks, as in single line JSON with quoted strings tracked, the rest of
+// the input is encoded serially so that memory use stays bounded.  Since
+// markers pause formatting across lines, inputs are encoded serially if
+// Options.Markers are enabled.
+//
+// Options.Replace is called concurrently, and not in input order, so it
+// must be safe for concurrent use.
+type ParallelEncoder struct {
+	w         io.Writer
+	opts      Options
+	workers   int
+	chunkSize int
+	stats     Stats
+	offsets   OffsetMap
+	free      chan *chunk
+}
+
+// maxChunkGrowth is the number of times the chunk size a chunk may grow to
+// while looking for a boundary.
+const maxChunkGrowth = 4
+
+// A chunk is a part of the input that is formatted by a single worker.
+type chunk struct {
+	data   []byte
+	offset int64 // position of the first byte of data in the input
+	line   int
+	col    int
+	out    []byte
+	stats  Stats
+	segs   []Segment
+	done   chan struct{}
+}
+
+// NewParallelEncoder, returns a ParallelEncoder that writes to w using the
+// given number of worker goroutines.  If workers is less than 1, the value
+// of runtime.GOMAXPROCS is used.
+func NewParallelEncoder(w io.Writer, workers int) *ParallelEncoder {
+	if workers < 1 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	return &ParallelEncoder{w: w, workers: workers, chunkSize: 1024 * 1024}
+}
+
+// SetOptions, sets the options used to detect and format numbers.
+func (e *ParallelEncoder) SetOptions(opts Options) {
+	e.opts = opts
+}
+
+// Stats, returns the counters of the work done by the last call to Encode.
+// Carries counts the writes to the Num of each chunk.
+func (e *ParallelEncoder) Stats() Stats {
+	return e.stats
+}
+
+// Offsets, returns the map of byte offsets between the input and output of
+// the last call to Encode, see Options.Offsets.
+func (e *ParallelEncoder) Offsets() *OffsetMap {
+	return &e.offsets
+}
+
+// Encode, reads r to EOF formatting any numbers and writes the results to
+// the underlying io.Writer.  If reading from r fails the output of the
+// chunks read before the error is written and the error is returned.
+func (e *ParallelEncoder) Encode(r io.Reader) error {
+	e.stats = Stats{}
+	e.offsets.Reset()
+	if e.opts.Markers.enabled() {
+		return e.encodeSerial(&chunk{line: 1, col: 1}, r, 0)
+	}
+	if e.free == nil {
+		e.free = make(chan *chunk, 2*e.workers+2)
+	}
+
+	// ordered holds the chunks in input order and bounds the number of
+	// chunks in flight.
+	jobs := make(chan *chunk)
+	ordered := make(chan *chunk, e.workers)
+	stop := make(chan struct{}) // closed if writing fails
+	var wg sync.WaitGroup
+	for i := 0; i < e.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n := New()
+			n.SetOptions(e.opts)
+			for c := range jobs {
+				e.format(n, c)
+				close(c.done)
+			}
+		}()
+	}
+	var out int64 // length of the output written by writeChunks
+	werr := make(chan error, 1)
+	go func() {
+		werr <- e.writeChunks(ordered, stop, &out)
+	}()
+
+	rest, rerr := e.split(r, func(c *chunk) bool {
+		select {
+		case ordered <- c:
+		case <-stop:
+			return false
+		}
+		jobs <- c
+		return true
+	})
+	close(jobs)
+	close(ordered)
+	wg.Wait()
+	if err := <-werr; err != nil {
+		return err
+	}
+	if rest != nil {
+		return e.encodeSerial(rest, r, out)
+	}
+	return rerr
+}
+
+// encodeSerial, formats the data of chunk c followed by the rest of r with
+// an Encoder that continues at the position of c in the input and at
+// offset out in the output.
+func (e *ParallelEncoder) encodeSerial(c *chunk, r io.Reader, out int64) error {
+	enc := NewEncoder(e.w)
+	enc.SetOptions(e.opts)
+	enc.n.lex.offset = c.offset
+	enc.n.lex.line = c.line
+	enc.n.lex.col = c.col
+	err := enc.Encode(io.MultiReader(bytes.NewReader(c.data), r))
+	e.stats.Add(enc.Stats())
+	for _, s := range enc.Offsets().Segments() {
+		e.offsets.add(s.In, s.Out+out)
+	}
+	return err
+}
+
+// format, formats chunk c with n.
+func (e *ParallelEncoder) format(n *Num, c *chunk) {
+	n.Reset()
+	n.lex.offset = c.offset
+	n.lex.line = c.line
+	n.lex.col = c.col
+	n.Write(c.data)
+	n.Flush()
+	c.out = append(c.out[:0], n.buf.Bytes()...)
+	c.stats = n.Stats()
+	c.segs = append(c.segs[:0], n.Offsets().Segments()...)
+}
+
+// writeChunks, writes the output of the chunks in order and collects their
+// statistics and offsets.  The length of the output is stored in out.
+func (e *ParallelEncoder) writeChunks(ordered <-chan *chunk, stop chan struct{}, out *int64) error {
+	var err error
+	for c := range ordered {
+		<-c.done
+		if err == nil {
+			if _, err = e.w.Write(c.out); err != nil {
+				close(stop)
+			}
+			for _, s := range c.segs {
+				e.offsets.add(s.In, s.Out+*out)
+			}
+			e.stats.Add(c.stats)
+			*out += int64(len(c.out))
+		}
+		select {
+		case e.free <- c:
+		default:
+		}
+	}
+	return err
+}
+
+func (e *ParallelEncoder) newChunk() *chunk {
+	var c *chunk
+	select {
+	case c = <-e.free:
+	default:
+		c = new(chunk)
+	}
+	c.data = c.data[:0]
+	c.done = make(chan struct{})
+	return c
+}
+
+// split, reads r and passes chunks that end at a boundary to send until
+// EOF, a read error, or send returns false.  If a chunk has no boundary
+// within maxChunkGrowth times the chunk size it is returned, unsent, to be
+// encoded serially with the rest of r.
+func (e *ParallelEncoder) split(r io.Reader, send func(*chunk) bool) (*chunk, error) {
+	var carry []byte // input after the last boundary of the previous chunk
+	var offset int64
+	line, col := 1, 1
+	for {
+		c := e.newChunk()
+		c.data = append(c.data, carry...)
+		var err error
+		i := -1
+		for size := e.chunkSize; ; size += e.chunkSize {
+			start := len(c.data)
+			c.data, err = fill(r, c.data, size)
+			if err != nil {
+				break
+			}
+			if i = e.boundary(c.data[start:]); i >= 0 {
+				i += start
+				break
+			}
+			if size >= maxChunkGrowth*e.chunkSize {
+				c.offset, c.line, c.col = offset, line, col
+				return c, nil
+			}
+		}
+		switch {
+		case err == io.EOF:
+			i = len(c.data)
+		case err != nil:
+			// format the input up to the last boundary
+			i = e.boundary(c.data)
+			if i <= 0 {
+				return nil, err
+			}
+		}
+		carry = append(carry[:0], c.data[i:]...)
+		c.data = c.data[:i]
+		c.offset = offset
+		c.line = line
+		c.col = col
+		offset += int64(len(c.data))
+		if j := bytes.LastIndexByte(c.data, '\n'); j >= 0 {
+			line += bytes.Count(c.data[:j+1], []byte{'\n'})
+			col = len(c.data) - j
+		} else {
+			col += len(c.data)
+		}
+		if len(c.data) != 0 && !send(c) {
+			return nil, nil
+		}
+		if err != nil {
+			if err == io.EOF {
+				err = nil
+			}
+			return nil, err
+		}
+	}
+}
+
+// fill, reads from r into p until it holds n bytes.
+func fill(r io.Reader, p []byte, n int) ([]byte, error) {
+	if cap(p) < n {
+		b := make([]byte, len(p), n+cap(p))
+		copy(b, p)
+		p = b
+	}
+	for len(p) < n {
+		m, err := r.Read(p[len(p):n])
+		p = p[:len(p)+m]
+		if err != nil {
+			return p, err
+		}
+	}
+	return p, nil
+}
+
+// boundary, returns the index after the last byte of b after which the
+// scanner is always in its initial state, or -1.
+func (e *ParallelEncoder) boundary(b []byte) int {
+	if e.opts.Quotes == QuoteNone {
+		if i := lastSpace(b); i >= 0 {
+			return i + 1
+		}
+		return -1
+	}
+	for i := len(b) - 1; i > 0; i-- {
+		if b[i] == '\n' && b[i-1] != '\\' {
+			return i + 1
+		}
+	}
+	return -1
+}
@@ -0,0 +1,274 @@
+package num
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"testing/iotest"
+)
+
+// Test that the bytes the input is split at return every reachable state
+// of the scanner to its initial state.
+func TestParallelBoundary(t *testing.T) {
+	const initial = stBegin
+	for mode := range scanTables {
+		tab := &scanTables[mode]
+		step := func(st, cls int) int {
+			return int(tab[st*classStride+cls] & 0xff)
+		}
+		// next, returns the states after c, which may be the first byte
+		// of a rune that the lexer decodes to one of two classes.
+		next := func(st int, c byte) []int {
+			if t := tab[st*classStride+int(byteClass[c])]; t>>8 != scanRune {
+				return []int{int(t & 0xff)}
+			}
+			return []int{step(st, clsHigh), step(st, clsSpace)}
+		}
+		reachable := []int{initial}
+		seen := map[int]bool{initial: true}
+		for i := 0; i < len(reachable); i++ {
+			for c := 0; c < 256; c++ {
+				for _, st := range next(reachable[i], byte(c)) {
+					if !seen[st] {
+						seen[st] = true
+						reachable = append(reachable, st)
+					}
+				}
+			}
+		}
+		e := ParallelEncoder{opts: Options{Quotes: QuoteMode(mode)}}
+		for _, st := range reachable {
+			if st%numBaseStates == stError {
+				continue
+			}
+			for p := 0; p < 256; p++ {
+				for c := 0; c < 256; c++ {
+					if e.boundary([]byte{byte(p), byte(c)}) != 2 {
+						continue
+					}
+					for _, ps := range next(st, byte(p)) {
+						if got := step(ps, int(byteClass[c])); got != initial {
+							t.Errorf("mode %d: state %d: bytes %q: got state %d want: %d",
+								mode, st, []byte{byte(p), byte(c)}, got, initial)
+						}
+					}
+				}
+			}
+		}
+	}
+}
+
+// randomText, returns text with many numbers, quotes and escapes.
+func randomText(size int) []byte {
+	words := []string{
+		"1234567", "-1234.5", "$1234567", "(1234)", "12345KB", "1,234,567",
+		"0x1234567", "id1234567", "\"", "'", "\\", "\\\"", " ", "  ", "\n",
+		"\t", " ", "　", "a", "1234567890123456789", "num:off",
+		"num:on", ".", "%", "\\\n",
+	}
+	rr := rand.New(rand.NewSource(1))
+	var b []byte
+	for len(b) < size {
+		b = append(b, words[rr.Intn(len(words))]...)
+	}
+	return b
+}
+
+func TestParallelEncoder(t *testing.T) {
+	// render the position of large numbers to check that the chunks are
+	// formatted at their position in the input
+	position := func(dst []byte, t *Token) ([]byte, bool) {
+		if len(t.Raw) < 12 {
+			return dst, false
+		}
+		return append(dst, fmt.Sprintf("<%d:%d:%d>", t.Offset, t.Line, t.Column)...), true
+	}
+	opts := []Options{
+		{},
+		{Regroup: true, Offsets: true},
+		{Quotes: QuoteSkip},
+		{Quotes: QuoteFormat, Offsets: true},
+		{MaxTokenLen: 8},
+		{Replace: position},
+		{Quotes: QuoteSkip, Replace: position},
+		{Markers: Markers{Off: "num:off", On: "num:on"}, Offsets: true},
+	}
+	inputs := []struct {
+		name  string
+		in    []byte
+		sizes []int
+	}{
+		{"testdata", testdata[:256*1024], []int{100, 4096, 64 * 1024}},
+		{"random", randomText(64 * 1024), []int{1, 100, 4096}},
+		// a line without a boundary in any mode is encoded serially
+		{"long line", longLine(), []int{100, 4096}},
+	}
+	for _, x := range inputs {
+		for _, o := range opts {
+			testParallelEncoder(t, x.name, x.in, o, x.sizes)
+		}
+	}
+}
+
+// Test the whole of testdata with the default options and chunk size.
+func TestParallelEncoderTestdata(t *testing.T) {
+	if testing.Short() {
+		t.Skip("short test")
+	}
+	testParallelEncoder(t, "testdata", testdata, Options{}, []int{1024 * 1024})
+}
+
+// testParallelEncoder, checks that a ParallelEncoder with each chunk size in
+// sizes produces the same output, Stats and Offsets as an Encoder.
+func testParallelEncoder(t *testing.T, name string, in []byte, o Options, sizes []int) {
+	t.Helper()
+	var want bytes.Buffer
+	enc := NewEncoder(&want)
+	enc.SetOptions(o)
+	if err := enc.Encode(bytes.NewReader(in)); err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range sizes {
+		var got bytes.Buffer
+		p := NewParallelEncoder(&got, 4)
+		p.chunkSize = size
+		p.SetOptions(o)
+		if err := p.Encode(bytes.NewReader(in)); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got.Bytes(), want.Bytes()) {
+			t.Errorf("%s: %+v: chunk size %d: output differs from Encoder", name, o, size)
+			continue
+		}
+		gs, ws := p.Stats(), enc.Stats()
+		gs.Carries, ws.Carries = 0, 0
+		if gs != ws {
+			t.Errorf("%s: %+v: chunk size %d: Stats: got %+v want: %+v",
+				name, o, size, gs, ws)
+		}
+		if g, w := p.Offsets().Segments(), enc.Offsets().Segments(); !equalSegments(g, w) {
+			t.Errorf("%s: %+v: chunk size %d: Offsets: got %d segments want: %d",
+				name, o, size, len(g), len(w))
+		}
+	}
+}
+
+// longLine, returns lines of text followed by a long line without spaces
+// or newlines.
+func longLine() []byte {
+	b := randomText(16 * 1024)
+	b = append(b, '\n')
+	for i := 0; i < 4096; i++ {
+		b = append(b, "x\"1234567\"-1234.5"...)
+	}
+	return append(b, randomText(1024)...)
+}
+
+func equalSegments(a, b []Segment) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	atomic.AddInt64(&r.n, int64(n))
+	return n, err
+}
+
+// A firstWriter records the bytes read from r when output is first written.
+type firstWriter struct {
+	r     *countingReader
+	first int64
+	buf   bytes.Buffer
+}
+
+func (w *firstWriter) Write(p []byte) (int, error) {
+	if w.buf.Len() == 0 {
+		w.first = atomic.LoadInt64(&w.r.n)
+	}
+	return w.buf.Write(p)
+}
+
+// Test that a single huge line, with no unescaped newline to split at, is
+// streamed instead of being read into memory.
+func TestParallelEncoderLongLine(t *testing.T) {
+	in := bytes.Repeat([]byte(`{"id": "abc 1234567", "n": 1234567} `), 64*1024)
+	var want bytes.Buffer
+	enc := NewEncoder(&want)
+	enc.SetOptions(Options{Quotes: QuoteSkip})
+	if err := enc.Encode(bytes.NewReader(in)); err != nil {
+		t.Fatal(err)
+	}
+
+	r := &countingReader{r: bytes.NewReader(in)}
+	w := &firstWriter{r: r}
+	p := NewParallelEncoder(w, 4)
+	p.chunkSize = 4096
+	p.SetOptions(Options{Quotes: QuoteSkip})
+	if err := p.Encode(r); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(w.buf.Bytes(), want.Bytes()) {
+		t.Error("output differs from Encoder")
+	}
+	if max := int64(len(in) / 8); w.first > max {
+		t.Errorf("read %d bytes before the first write, want at most %d of %d",
+			w.first, max, len(in))
+	}
+}
+
+func TestParallelEncoderError(t *testing.T) {
+	errWrite := errors.New("write error")
+	p := NewParallelEncoder(&errWriter{errWrite}, 4)
+	p.chunkSize = 100
+	if err := p.Encode(bytes.NewReader(testdata)); err != errWrite {
+		t.Errorf("Encode: got error %v want: %v", err, errWrite)
+	}
+
+	errRead := errors.New("read error")
+	var buf bytes.Buffer
+	p = NewParallelEncoder(&buf, 4)
+	p.chunkSize = 100
+	r := io.MultiReader(strings.NewReader("a 1234567\nb 1234567\nc 12"), iotest.ErrReader(errRead))
+	if err := p.Encode(r); err != errRead {
+		t.Errorf("Encode: got error %v want: %v", err, errRead)
+	}
+	if got, want := buf.String(), "a 1,234,567\nb 1,234,567\nc "; got != want {
+		t.Errorf("Encode: got %q want: %q", got, want)
+	}
+}
+
+func BenchmarkParallelEncoder(b *testing.B) {
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprint(workers), func(b *testing.B) {
+			p := NewParallelEncoder(&NopWriter{}, workers)
+			r := bytes.NewReader(testdata)
+			b.SetBytes(int64(len(testdata)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				r.Seek(0, 0)
+				if err := p.Encode(r); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,53 @@
+package num
+
+import "io"
+
+// A Reader formats the numbers in the data read from an underlying
+// io.Reader.  Data is read lazily, one chunk at a time, as formatted
+// output is consumed, so only a chunk of input, its formatted output and
+// a pending number are buffered.
+type Reader struct {
+	r   io.Reader
+	n   Num
+	buf []byte
+	err error
+}
+
+// NewReader, returns a new Reader that reads from r.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: r}
+}
+
+// SetOptions, sets the options used to detect and format numbers.
+func (r *Reader) SetOptions(opts Options) {
+	r.n.SetOptions(opts)
+}
+
+// Read, reads up to len(p) bytes of formatted output into p.  A number
+// that straddles reads from the underlying io.Reader is formatted once it
+// is complete.  Once the underlying io.Reader returns io.EOF any pending
+// number is finished.  Other read errors are returned after the completed
+// output has been read.
+func (r *Reader) Read(p []byte) (int, error) {
+	for r.n.buf.Len() == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if len(r.buf) == 0 {
+			r.buf = make([]byte, 32*1024)
+		}
+		n, err := r.r.Read(r.buf)
+		if n > 0 {
+			if _, werr := r.n.Write(r.buf[:n]); werr != nil {
+				err = werr
+			}
+		}
+		if err == io.EOF {
+			if ferr := r.n.Flush(); ferr != nil {
+				err = ferr
+			}
+		}
+		r.err = err
+	}
+	return r.n.Read(p)
+}
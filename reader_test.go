@@ -0,0 +1,34 @@
+package num
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestReader(t *testing.T) {
+	tests := streamTests()
+	for name, fn := range testReaders {
+		for _, x := range tests {
+			r := NewReader(fn(strings.NewReader(x.In)))
+			if err := iotest.TestReader(r, []byte(x.Out)); err != nil {
+				t.Errorf("Reader (%s): %.40q: %v", name, x.In, err)
+			}
+		}
+	}
+}
+
+func TestReaderError(t *testing.T) {
+	errRead := errors.New("read error")
+	r := NewReader(io.MultiReader(strings.NewReader("a 1234567 b 1234"), iotest.ErrReader(errRead)))
+	var buf bytes.Buffer
+	if _, err := io.Copy(&buf, r); err != errRead {
+		t.Errorf("Read: got error %v want: %v", err, errRead)
+	}
+	if out, want := buf.String(), "a 1,234,567 b "; out != want {
+		t.Errorf("Read: got output %q want: %q", out, want)
+	}
+}
@@ -34,6 +34,11 @@
 
 package num
 
+import (
+	"errors"
+	"fmt"
+)
+
 const (
 	scanContinue = iota
 	scanBeginValue
@@ -42,49 +47,265 @@ const (
 	scanEndNum
 	scanNotNum
 	scanSkipSpace
-	scanEnd
 	scanError
+	scanRune // the byte may begin a multi-byte space, see runeClass
 )
 
 const (
 	parseValue = iota
 	parseNum
-	parseEnd
 )
 
+// Sentinel errors wrapped by ScannerError, for use with errors.Is.
+var (
+	ErrInvalidState = errors.New("invalid parse state")
+)
+
+// A ScannerError describes an error encountered while scanning the input.
 type ScannerError struct {
-	msg   string
-	bytes int64
+	Err     error  // the sentinel error, such as ErrInvalidState
+	Offset  int64  // byte offset of the offending byte in the input
+	Line    int    // 1-based line of the offending byte
+	Column  int    // 1-based byte column of the offending byte
+	Byte    byte   // the offending byte
+	Snippet string // the input surrounding the offending byte
 }
 
 func (s ScannerError) Error() string {
-	return s.msg
+	return fmt.Sprintf("num: %s at line %d, column %d (offset %d): byte %q in %q",
+		s.Err, s.Line, s.Column, s.Offset, s.Byte, s.Snippet)
 }
 
+// Unwrap, returns the sentinel error.
+func (s ScannerError) Unwrap() error {
+	return s.Err
+}
+
+// Bytes, returns the number of bytes scanned, including the offending byte.
 func (s ScannerError) Bytes() int64 {
-	return s.bytes
+	return s.Offset + 1
+}
+
+// The scanner is a table driven deterministic finite automaton.  Each byte
+// is mapped to a byte class and the next state and scan code are looked up
+// in a transition table indexed by the current state and the byte class.
+//
+// The transition tables, one per QuoteMode, are generated when the package
+// is initialized by evaluating the transition rules of the generator for
+// every state and byte class.
+
+// Byte classes.  All bytes in a class have the same transitions.
+const (
+	clsOther     = iota
+	clsSpace     // ' ', '\t', '\r', '\v', '\f'
+	clsNewline   // '\n'
+	clsCtrl      // other control characters
+	clsOpen      // '[', '{'
+	clsParen     // '('
+	clsClose     // ')'
+	clsEnd       // ']', '}'
+	clsDQuote    // '"'
+	clsSQuote    // '\''
+	clsPercent   // '%'
+	clsColon     // ':'
+	clsZero      // '0'
+	clsDigit     // '1' - '9'
+	clsMinus     // '-'
+	clsDot       // '.'
+	clsComma     // ','
+	clsTrail     // ';', '!', '?'
+	clsSlash     // '/'
+	clsDollar    // '$'
+	clsUpper     // 'A' - 'Z'
+	clsLower     // 'a' - 'z'
+	clsHigh      // 0x80 - 0xFF
+	clsLead      // 0xC2, 0xE1, 0xE2, 0xE3: may begin a multi-byte space
+	clsBackslash // '\\'
+	numClasses
+
+	// classStride is the distance between the rows of a scanTable.  It is
+	// a power of two, not numClasses, so that indexing a row is a shift.
+	classStride = 32
+)
+
+func classOf(c byte) uint8 {
+	switch {
+	case c == ' ' || c == '\t' || c == '\r' || c == '\v' || c == '\f':
+		return clsSpace
+	case c == '\n':
+		return clsNewline
+	case c < ' ':
+		return clsCtrl
+	case c == '[' || c == '{':
+		return clsOpen
+	case c == '(':
+		return clsParen
+	case c == ')':
+		return clsClose
+	case c == ']' || c == '}':
+		return clsEnd
+	case c == '"':
+		return clsDQuote
+	case c == '\'':
+		return clsSQuote
+	case c == '%':
+		return clsPercent
+	case c == ':':
+		return clsColon
+	case c == '0':
+		return clsZero
+	case '1' <= c && c <= '9':
+		return clsDigit
+	case c == '-':
+		return clsMinus
+	case c == '.':
+		return clsDot
+	case c == ',':
+		return clsComma
+	case c == ';' || c == '!' || c == '?':
+		return clsTrail
+	case c == '/':
+		return clsSlash
+	case c == '$':
+		return clsDollar
+	case 'A' <= c && c <= 'Z':
+		return clsUpper
+	case 'a' <= c && c <= 'z':
+		return clsLower
+	case isSpaceLead(int(c)):
+		return clsLead
+	case c >= 0x80:
+		return clsHigh
+	case c == '\\':
+		return clsBackslash
+	}
+	return clsOther
+}
+
+// Base states.  Each base state exists once per quote context: outside of
+// a quoted string, in a double quoted string and in a single quoted string.
+const (
+	stBegin       = iota // beginning of a value
+	stInValue            // in a value that is not a number
+	stValueEscape        // after a backslash in a value in a quoted string
+	stParen              // after an opening parenthesis
+	stNeg                // after a minus sign
+	stPrefix1            // after the first byte of a currency prefix
+	stPrefix2            // after the second byte of a currency prefix
+	stPrefix3            // after the third byte of a currency prefix
+	stDigit              // the next byte must be the first digit
+	stInt                // in the integer digits
+	stZero               // after a leading zero
+	stComma              // after a comma in the integer digits
+	stDot                // after the decimal point
+	stFrac               // in the fraction digits
+	stSuffix             // in a unit, percent or currency suffix
+	stClose              // after a closing parenthesis
+	stTrail              // after punctuation that follows the digits
+	stInQuote            // in a quoted string that is not formatted
+	stEscape             // after a backslash in a quoted string
+	stQuoteClose         // after a possible closing quote
+	stError
+	numBaseStates
+)
+
+// Quote contexts.
+const (
+	ctxNone = iota
+	ctxDouble
+	ctxSingle
+	numContexts
+)
+
+const numStates = numBaseStates * numContexts
+
+// maxPrefix is the maximum length of a currency prefix in bytes.
+const maxPrefix = stPrefix3 - stPrefix1 + 1
+
+// A transition holds the next state in the low byte and the scan code in
+// the high byte.
+type transition uint16
+
+type scanTable [numStates * classStride]transition
+
+var (
+	byteClass  [256]uint8
+	scanTables [QuoteFormat + 1]scanTable
+	numState   [numStates]bool // the state is part of a number
+)
+
+func init() {
+	for c := 0; c < len(byteClass); c++ {
+		byteClass[c] = classOf(byte(c))
+	}
+	var rep [numClasses]int // a representative byte of each class
+	for c := len(byteClass) - 1; c >= 0; c-- {
+		rep[byteClass[c]] = c
+	}
+	for mode := range scanTables {
+		g := generator{mode: QuoteMode(mode)}
+		for st := 0; st < numStates; st++ {
+			for cls := 0; cls < numClasses; cls++ {
+				next, code := g.next(st%numBaseStates, st/numBaseStates, rep[cls])
+				scanTables[mode][st*classStride+cls] = transition(next) | transition(code)<<8
+			}
+		}
+	}
+	for st := 0; st < numStates; st++ {
+		switch st % numBaseStates {
+		case stParen, stNeg, stPrefix1, stPrefix2, stPrefix3, stDigit, stInt,
+			stZero, stComma, stDot, stFrac, stSuffix, stClose, stTrail:
+			numState[st] = true
+		}
+	}
 }
 
 type scanner struct {
-	step       func(*scanner, int) int
-	parseState int
-	bytes      int64
-	err        error
+	tab   *scanTable
+	state uint8
+	err   error
 }
 
 func newScanner() *scanner {
-	return &scanner{step: stateBeginValue}
+	s := &scanner{tab: &scanTables[QuoteNone]}
+	s.reset()
+	return s
 }
 
 func (s *scanner) reset() {
-	s.step = stateBeginValue
-	s.parseState = 0
-	s.bytes = 0
+	s.restart()
 	s.err = nil
 }
 
+// restart, resets the parse state of the scanner.
+func (s *scanner) restart() {
+	s.state = stBegin
+}
+
+// setQuotes, sets how quoted strings are handled.
+func (s *scanner) setQuotes(mode QuoteMode) {
+	if mode < QuoteNone || mode > QuoteFormat {
+		mode = QuoteNone
+	}
+	s.tab = &scanTables[mode]
+}
+
+// inNum, reports if the scanner is in a number.
+func (s *scanner) inNum() bool {
+	return numState[s.state]
+}
+
+// isSpace reports if c is an ASCII space.  Multi-byte Unicode spaces are
+// decoded by the lexer.
 func isSpace(c rune) bool {
-	return c == ' ' || c == '\t' || c == '\r' || c == '\n'
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n' || c == '\v' || c == '\f'
+}
+
+// isSpaceLead reports if c is the first byte of the UTF-8 encoding of a
+// Unicode White_Space character above U+007F: U+0085, U+00A0, U+1680,
+// U+2000 - U+200A, U+2028, U+2029, U+202F, U+205F and U+3000.
+func isSpaceLead(c int) bool {
+	return c == 0xC2 || c == 0xE1 || c == 0xE2 || c == 0xE3
 }
 
 func isStart(c rune) bool {
@@ -95,106 +316,264 @@ func isEnd(c rune) bool {
 	return c == ')' || c == ']' || c == '}' || c == '"' || c == '\'' || c == '%'
 }
 
-func stateBeginValue(s *scanner, c int) int {
-	switch {
-	case c < ' ' || isSpace(rune(c)) || isStart(rune(c)):
-		return scanSkipSpace
-	case '1' <= c && c <= '9':
-		s.step = state1
-		s.parseState = parseNum
-		return scanBeginNum
-	case c == '0': // beginning of 0.123
-		s.step = state0
-		s.parseState = parseNum
-		return scanBeginNum
-	case c == '-':
-		s.step = stateNeg
-		s.parseState = parseNum
-		return scanBeginValue
-	default:
-		s.step = stateInValue
-		s.parseState = parseValue
-		return scanBeginValue
+// isTrail reports if c is punctuation that may follow a number, such as
+// "1,234.5," or "(1,234)."
+func isTrail(c int) bool {
+	return c == '.' || c == ',' || c == ';' || c == '!' || c == '?'
+}
+
+// isUnit reports if c may begin a unit suffix, such as "ns" or "µs".
+func isUnit(c int) bool {
+	return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || c >= 0x80
+}
+
+// isCurrencyStart reports if c may begin a currency prefix, such as "$",
+// "€" or "USD".
+func isCurrencyStart(c int) bool {
+	return c == '$' || 'A' <= c && c <= 'Z' || c >= 0x80
+}
+
+// A generator evaluates the transition rules of the scanner for a
+// QuoteMode.
+type generator struct {
+	mode QuoteMode
+}
+
+// state returns the state for base state base in quote context ctx.
+func state(base, ctx int) int {
+	return base + ctx*numBaseStates
+}
+
+// quoteOf returns the quote character of quote context ctx.
+func quoteOf(ctx int) int {
+	switch ctx {
+	case ctxDouble:
+		return '"'
+	case ctxSingle:
+		return '\''
 	}
+	return -1
 }
 
-func stateEndValue(s *scanner, c int) int {
-	switch s.parseState {
-	case parseNum:
-		if isSpace(rune(c)) || isEnd(rune(c)) || c == ':' {
-			s.step = stateBeginValue
-			s.parseState = parseEnd
-			return scanEndNum
+// next, returns the next state and scan code after reading byte c in base
+// state base and quote context ctx.
+func (g *generator) next(base, ctx, c int) (int, int) {
+	if base != stError && isSpaceLead(c) {
+		// The lexer decodes the rune and steps the scanner by either a
+		// space or a high byte.
+		return state(base, ctx), scanRune
+	}
+	q := quoteOf(ctx)
+	switch base {
+	case stBegin:
+		return g.begin(ctx, c)
+	case stInValue:
+		if ctx != ctxNone {
+			if c == '\\' {
+				return state(stValueEscape, ctx), scanContinue
+			}
+			if c == q {
+				return g.endValue(ctx, c, parseValue)
+			}
+		}
+		if !isSpace(rune(c)) {
+			return state(stInValue, ctx), scanContinue
+		}
+		return g.endValue(ctx, c, parseValue)
+	case stValueEscape:
+		return state(stInValue, ctx), scanContinue
+	case stParen:
+		switch {
+		case c == '(':
+			return g.begin(ctx, c)
+		case c == '-':
+			return state(stNeg, ctx), scanContinue
+		}
+		return g.next(stNeg, ctx, c)
+	case stNeg:
+		if isCurrencyStart(c) {
+			return state(stPrefix1, ctx), scanContinue
+		}
+		return g.next(stDigit, ctx, c)
+	case stPrefix1, stPrefix2, stPrefix3:
+		if isCurrencyStart(c) && base < stPrefix3 {
+			return state(base+1, ctx), scanContinue
+		}
+		if c == '-' {
+			return state(stDigit, ctx), scanContinue
+		}
+		return g.next(stDigit, ctx, c)
+	case stDigit:
+		if c == '0' {
+			return state(stZero, ctx), scanContinue
+		}
+		if '1' <= c && c <= '9' {
+			return state(stInt, ctx), scanContinue
+		}
+		return g.endValue(ctx, c, parseNum)
+	case stInt:
+		if '0' <= c && c <= '9' {
+			return state(stInt, ctx), scanContinue
+		}
+		if c == ',' {
+			return state(stComma, ctx), scanContinue
+		}
+		return g.next(stZero, ctx, c)
+	case stComma:
+		// The comma is either a thousands separator, if followed by a
+		// digit, or punctuation that is checked by the lexer.
+		if '0' <= c && c <= '9' {
+			return state(stInt, ctx), scanContinue
+		}
+		return g.endValue(ctx, c, parseNum)
+	case stZero:
+		if '0' <= c && c <= '9' { // leading zero: checked by isIdentifier
+			return state(stInt, ctx), scanContinue
 		}
-		s.parseState = parseValue
-		s.step = stateInValue
-		return scanNotNum
-	case parseValue:
-		s.step = stateBeginValue
-		s.parseState = parseEnd
-		return scanEndValue
+		if c == '.' {
+			return state(stDot, ctx), scanContinue
+		}
+		return g.endNum(ctx, c)
+	case stDot:
+		if '0' <= c && c <= '9' {
+			return state(stFrac, ctx), scanContinue
+		}
+		return g.endValue(ctx, c, parseNum)
+	case stFrac:
+		if '0' <= c && c <= '9' {
+			return state(stFrac, ctx), scanContinue
+		}
+		return g.endNum(ctx, c)
+	case stSuffix:
+		// Whether the suffix is a known unit is checked by the lexer.
+		if isUnit(c) || c == '/' {
+			return state(stSuffix, ctx), scanContinue
+		}
+		if c == ')' {
+			return state(stClose, ctx), scanContinue
+		}
+		return g.next(stClose, ctx, c)
+	case stClose:
+		if isTrail(c) {
+			return state(stBegin, ctx), scanEndNum
+		}
+		return g.endValue(ctx, c, parseNum)
+	case stTrail:
+		// Punctuation after the digits ends a sentence or list only if
+		// a boundary follows, so "1.2.3" is not a number.
+		return g.endValue(ctx, c, parseNum)
+	case stInQuote:
+		if c == q || c == '\\' || c == '\n' {
+			return g.quote(ctx, c)
+		}
+		return state(stInQuote, ctx), scanContinue
+	case stEscape:
+		return state(g.quoteState(), ctx), scanContinue
+	case stQuoteClose:
+		// A doubled quote is an escaped quote.
+		if c == q {
+			return state(g.quoteState(), ctx), scanContinue
+		}
+		return g.begin(ctxNone, c)
 	}
-	return s.error(c, "invalid parse state")
+	return state(stError, ctx), scanError
 }
 
-func stateInValue(s *scanner, c int) int {
-	if !isSpace(rune(c)) {
-		s.step = stateInValue
-		return scanContinue
+func (g *generator) begin(ctx, c int) (int, int) {
+	switch {
+	case ctx != ctxNone && (c == quoteOf(ctx) || c == '\\' || c == '\n'),
+		g.mode != QuoteNone && ctx == ctxNone && (c == '"' || c == '\''):
+		return g.quote(ctx, c)
+	case c < ' ' || isSpace(rune(c)) || (isStart(rune(c)) && c != '('):
+		return state(stBegin, ctx), scanSkipSpace
+	case '1' <= c && c <= '9':
+		return state(stInt, ctx), scanBeginNum
+	case c == '0': // beginning of 0.123
+		return state(stZero, ctx), scanBeginNum
+	case c == '-':
+		return state(stNeg, ctx), scanBeginNum
+	case c == '(': // beginning of an accounting negative: (123)
+		return state(stParen, ctx), scanBeginNum
+	case isCurrencyStart(c):
+		return state(stPrefix1, ctx), scanBeginNum
+	default:
+		return state(stInValue, ctx), scanBeginValue
 	}
-	return stateEndValue(s, c)
 }
 
-func stateNeg(s *scanner, c int) int {
-	if c == '0' {
-		s.step = state0
-		return scanBeginNum
+// endNum, returns the transition after the last digit of a number.
+func (g *generator) endNum(ctx, c int) (int, int) {
+	if isUnit(c) || c == '%' {
+		return state(stSuffix, ctx), scanContinue
 	}
-	if '1' <= c && c <= '9' {
-		s.step = state1
-		return scanBeginNum
+	if c == ')' {
+		return state(stClose, ctx), scanContinue
 	}
-	return stateEndValue(s, c)
-}
-
-func state1(s *scanner, c int) int {
-	if '0' <= c && c <= '9' {
-		s.step = state1
-		return scanContinue
+	if isTrail(c) {
+		return state(stTrail, ctx), scanContinue
 	}
-	return state0(s, c)
+	return g.endValue(ctx, c, parseNum)
 }
 
-func state0(s *scanner, c int) int {
-	if c == '.' {
-		s.step = stateDot
-		return scanContinue
+func (g *generator) endValue(ctx, c, parseState int) (int, int) {
+	if parseState == parseNum {
+		if isSpace(rune(c)) || isEnd(rune(c)) || c == ':' {
+			return g.endState(ctx, c), scanEndNum
+		}
+		if ctx != ctxNone && c == '\\' {
+			return state(stValueEscape, ctx), scanNotNum
+		}
+		return state(stInValue, ctx), scanNotNum
 	}
-	return stateEndValue(s, c)
+	return g.endState(ctx, c), scanEndValue
 }
 
-func stateDot(s *scanner, c int) int {
-	if '0' <= c && c <= '9' {
-		s.step = stateDot0
-		return scanContinue
+// endState, returns the state that follows a value terminated by c.
+func (g *generator) endState(ctx, c int) int {
+	if ctx != ctxNone {
+		if c == quoteOf(ctx) {
+			return state(stQuoteClose, ctx)
+		}
+		if c == '\n' {
+			return state(stBegin, ctxNone)
+		}
 	}
-	return stateEndValue(s, c)
+	return state(stBegin, ctx)
 }
 
-func stateDot0(s *scanner, c int) int {
-	if '0' <= c && c <= '9' {
-		s.step = stateDot0
-		return scanContinue
+// quote, handles the quote, backslash and newline characters when quoted
+// strings are tracked.  Quoted strings end at the matching quote or the
+// end of the line.
+func (g *generator) quote(ctx, c int) (int, int) {
+	switch {
+	case ctx == ctxNone:
+		if c == '"' {
+			ctx = ctxDouble
+		} else {
+			ctx = ctxSingle
+		}
+		return state(g.quoteState(), ctx), scanSkipSpace
+	case c == quoteOf(ctx):
+		return state(stQuoteClose, ctx), scanSkipSpace
+	case c == '\\':
+		return state(stEscape, ctx), scanSkipSpace
 	}
-	return stateEndValue(s, c)
+	return state(stBegin, ctxNone), scanSkipSpace // newline
 }
 
-func stateError(s *scanner, c int) int {
-	return scanError
+// quoteState, returns the base state at the start of, or after an escape
+// sequence in, a quoted string.
+func (g *generator) quoteState() int {
+	if g.mode == QuoteSkip {
+		return stInQuote
+	}
+	return stBegin
 }
 
-func (s *scanner) error(c int, context string) int {
-	s.step = stateError
-	s.err = &ScannerError{context, s.bytes}
+// error, sets the scanner error.  The position of the error is filled in
+// by the lexer, which tracks the position in the input.
+func (s *scanner) error(c byte, err error) int {
+	s.state = stError
+	s.err = &ScannerError{Err: err, Byte: c}
 	return scanError
 }
@@ -0,0 +1,36 @@
+package num
+
+// Stats are counters of the work done by a Num or Encoder since it was
+// created or last reset.
+type Stats struct {
+	BytesIn  int64 // bytes of input
+	BytesOut int64 // bytes of formatted output, including pending output
+	Numbers  int64 // numbers seen, including numbers left as is
+	Grouped  int64 // numbers whose thousands separators were added or changed
+	Replaced int64 // numbers rendered by Options.Replace
+
+	// Numbers left as is, by reason.
+	SkippedIdent   int64 // identifiers, see Options.MaxDigits and Options.Identifiers
+	SkippedGrouped int64 // numbers already grouped that are not regrouped
+	SkippedLong    int64 // tokens longer than Options.MaxTokenLen, not counted in Numbers
+
+	MaxLen  int   // length in bytes of the longest number
+	Carries int64 // writes that continued a number, rune or marker from the previous write
+}
+
+// Add, adds the counters of t to s, for example to total the Stats of
+// several Encoders.  MaxLen is the larger of the two.
+func (s *Stats) Add(t Stats) {
+	s.BytesIn += t.BytesIn
+	s.BytesOut += t.BytesOut
+	s.Numbers += t.Numbers
+	s.Grouped += t.Grouped
+	s.Replaced += t.Replaced
+	s.SkippedIdent += t.SkippedIdent
+	s.SkippedGrouped += t.SkippedGrouped
+	s.SkippedLong += t.SkippedLong
+	if t.MaxLen > s.MaxLen {
+		s.MaxLen = t.MaxLen
+	}
+	s.Carries += t.Carries
+}
@@ -0,0 +1,132 @@
+package num
+
+import (
+	"io"
+	"strconv"
+)
+
+// A TokenKind is the kind of a Token.
+type TokenKind int
+
+const (
+	// Text is any text that is not a number.
+	Text TokenKind = iota
+
+	// Number is a number, including any sign, currency, parenthesis and
+	// suffix.
+	Number
+)
+
+func (k TokenKind) String() string {
+	switch k {
+	case Text:
+		return "Text"
+	case Number:
+		return "Number"
+	}
+	return "TokenKind(" + strconv.Itoa(int(k)) + ")"
+}
+
+// A Span is the half-open range [Start, End) of a part of Token.Raw.
+type Span struct {
+	Start, End int
+}
+
+// A Token is a run of text or a number.
+type Token struct {
+	Kind TokenKind
+
+	// Raw is the token as it appears in the input.
+	Raw []byte
+
+	// Offset is the byte offset of the token in the input, and Line and
+	// Column its 1-based line and byte column.
+	Offset int64
+	Line   int
+	Column int
+
+	// The following fields are only set for Number tokens.
+
+	// Neg reports if the number is negative: it has a minus sign or is an
+	// accounting negative, such as "(1234)".
+	Neg bool
+
+	// Int is the span of the integer digits, including any thousands
+	// separators, and Frac the span of the fraction digits after the
+	// decimal point.  Frac is empty if the number has no fraction.
+	Int  Span
+	Frac Span
+
+	// Grouped reports if the integer already contains thousands
+	// separators.
+	Grouped bool
+
+	// Ident reports if the number is an identifier (see Options.MaxDigits
+	// and Options.Identifiers) that is not formatted.
+	Ident bool
+}
+
+// A Tokenizer splits the text read from an io.Reader into Text and Number
+// tokens using the same rules as Num.  A run of text may be split into
+// multiple consecutive Text tokens.
+type Tokenizer struct {
+	r    io.Reader
+	lex  lexer
+	buf  []byte
+	raw  []byte  // Raw bytes of the queued tokens
+	toks []Token // queued tokens
+	next int     // index of the next queued token
+	err  error
+}
+
+// NewTokenizer, returns a new Tokenizer that reads from r.
+func NewTokenizer(r io.Reader) *Tokenizer {
+	return &Tokenizer{r: r}
+}
+
+// SetOptions, sets the options used to detect numbers.
+func (t *Tokenizer) SetOptions(opts Options) {
+	t.lex.setOptions(opts)
+}
+
+// Next, returns the next token.  At the end of the input Next returns
+// io.EOF.  The Raw bytes of the token are only valid until the next call
+// to Next.
+func (t *Tokenizer) Next() (Token, error) {
+	for t.next == len(t.toks) {
+		if t.err != nil {
+			return Token{}, t.err
+		}
+		if len(t.buf) == 0 {
+			t.buf = make([]byte, 32*1024)
+		}
+		t.toks = t.toks[:0]
+		t.raw = t.raw[:0]
+		t.next = 0
+		n, err := t.r.Read(t.buf)
+		if n > 0 {
+			if werr := t.lex.write(t.buf[:n], t); werr != nil {
+				err = werr
+			}
+		}
+		if err == io.EOF {
+			if ferr := t.lex.flush(t); ferr != nil {
+				err = ferr
+			}
+		}
+		t.err = err
+	}
+	tok := t.toks[t.next]
+	t.next++
+	return tok, nil
+}
+
+func (t *Tokenizer) stripped(offset int64) {}
+
+func (t *Tokenizer) writeToken(tok *Token) {
+	// Copy the Raw bytes since the lexer reuses its buffer.
+	i := len(t.raw)
+	t.raw = append(t.raw, tok.Raw...)
+	t.toks = append(t.toks, *tok)
+	t.toks[len(t.toks)-1].Raw = t.raw[i:len(t.raw):len(t.raw)]
+}
@@ -0,0 +1,129 @@
+package num
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+type testToken struct {
+	Kind    TokenKind
+	Raw     string
+	Offset  int64
+	Line    int
+	Column  int
+	Neg     bool
+	Int     string
+	Frac    string
+	Grouped bool
+	Ident   bool
+}
+
+func tokenize(t *testing.T, r io.Reader, opts Options) []testToken {
+	var toks []testToken
+	tz := NewTokenizer(r)
+	tz.SetOptions(opts)
+	for {
+		tok, err := tz.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		x := testToken{
+			Kind:   tok.Kind,
+			Raw:    string(tok.Raw),
+			Offset: tok.Offset,
+			Line:   tok.Line,
+			Column: tok.Column,
+		}
+		if tok.Kind == Number {
+			x.Neg = tok.Neg
+			x.Int = string(tok.Raw[tok.Int.Start:tok.Int.End])
+			x.Frac = string(tok.Raw[tok.Frac.Start:tok.Frac.End])
+			x.Grouped = tok.Grouped
+			x.Ident = tok.Ident
+		}
+		// merge the text tokens split by reads
+		if n := len(toks); n != 0 && x.Kind == Text && toks[n-1].Kind == Text {
+			toks[n-1].Raw += x.Raw
+			continue
+		}
+		toks = append(toks, x)
+	}
+	return toks
+}
+
+func TestTokenizer(t *testing.T) {
+	const in = "a -1234.5 (1,234)\nx $99 007 12ns 12abc"
+	want := []testToken{
+		{Kind: Text, Raw: "a ", Offset: 0, Line: 1, Column: 1},
+		{Kind: Number, Raw: "-1234.5", Offset: 2, Line: 1, Column: 3, Neg: true, Int: "1234", Frac: "5"},
+		{Kind: Text, Raw: " ", Offset: 9, Line: 1, Column: 10},
+		{Kind: Number, Raw: "(1,234)", Offset: 10, Line: 1, Column: 11, Neg: true, Int: "1,234", Grouped: true},
+		{Kind: Text, Raw: "\nx ", Offset: 17, Line: 1, Column: 18},
+		{Kind: Number, Raw: "$99", Offset: 20, Line: 2, Column: 3, Int: "99"},
+		{Kind: Text, Raw: " ", Offset: 23, Line: 2, Column: 6},
+		{Kind: Number, Raw: "007", Offset: 24, Line: 2, Column: 7, Int: "007", Ident: true},
+		{Kind: Text, Raw: " ", Offset: 27, Line: 2, Column: 10},
+		{Kind: Number, Raw: "12ns", Offset: 28, Line: 2, Column: 11, Int: "12"},
+		{Kind: Text, Raw: " 12abc", Offset: 32, Line: 2, Column: 15},
+	}
+	for name, fn := range testReaders {
+		got := tokenize(t, fn(strings.NewReader(in)), Options{})
+		if len(got) != len(want) {
+			t.Errorf("%s: got %d tokens want: %d\n\tgot:  %+v\n\twant: %+v", name, len(got), len(want), got, want)
+			continue
+		}
+		for i := range got {
+			if got[i] != want[i] {
+				t.Errorf("%s: token %d:\n\tgot:  %+v\n\twant: %+v", name, i, got[i], want[i])
+			}
+		}
+	}
+}
+
+func TestTokenizerError(t *testing.T) {
+	tz := NewTokenizer(iotest.ErrReader(io.ErrUnexpectedEOF))
+	if _, err := tz.Next(); err != io.ErrUnexpectedEOF {
+		t.Errorf("Next: got error %v want: %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+// Test that the tokens reproduce the input and that Num formats exactly
+// the tokens that the Tokenizer reports as numbers.
+func TestTokenizerNum(t *testing.T) {
+	tz := NewTokenizer(bytes.NewReader(testdata))
+	var raw, formatted bytes.Buffer
+	var scratch []byte
+	for {
+		tok, err := tz.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw.Write(tok.Raw)
+		if tok.Kind == Number && !tok.Ident && !tok.Grouped {
+			scratch = append(scratch[:0], tok.Raw[:tok.Int.Start]...)
+			scratch = formatNumber(scratch, tok.Raw[tok.Int.Start:tok.Int.End])
+			scratch = append(scratch, tok.Raw[tok.Int.End:]...)
+			formatted.Write(scratch)
+		} else {
+			formatted.Write(tok.Raw)
+		}
+	}
+	if !bytes.Equal(raw.Bytes(), testdata) {
+		t.Error("Tokenizer: tokens do not reproduce the input")
+	}
+	n := New()
+	n.Write(testdata)
+	n.Flush()
+	if !bytes.Equal(n.buf.Bytes(), formatted.Bytes()) {
+		t.Error("Tokenizer: Num output does not match formatted tokens")
+	}
+}
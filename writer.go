@@ -0,0 +1,84 @@
+package num
+
+import (
+	"errors"
+	"io"
+)
+
+// ErrClosed is returned by the methods of a closed Writer.
+var ErrClosed = errors.New("num: write to closed Writer")
+
+// A Writer is an io.WriteCloser that formats the numbers in the data
+// written to it and writes the result to an underlying io.Writer.  Output
+// is written as it is completed: only a number at the end of the data
+// written so far, which may continue in the next call to Write, is held
+// back until the next call to Write, Flush or Close.
+type Writer struct {
+	w   io.Writer
+	n   Num
+	err error
+}
+
+// NewWriter, returns a new Writer that writes to w.  It is the caller's
+// responsibility to call Close on the Writer when done.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// SetOptions, sets the options used to detect and format numbers.
+func (w *Writer) SetOptions(opts Options) {
+	w.n.SetOptions(opts)
+}
+
+// Write, formats p and writes the completed output to the underlying
+// io.Writer.  Errors are sticky: once Write fails all following calls
+// return the same error.
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if _, err := w.n.Write(p); err != nil {
+		w.err = err
+		return 0, err
+	}
+	if err := w.writeOut(); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Flush, finishes any pending number and writes it to the underlying
+// io.Writer.  A number that continues in the next call to Write is
+// formatted as two numbers, so Flush should only be called at a boundary,
+// such as the end of a line or message.
+func (w *Writer) Flush() error {
+	if w.err != nil {
+		return w.err
+	}
+	if err := w.n.Flush(); err != nil {
+		w.err = err
+		return err
+	}
+	return w.writeOut()
+}
+
+// Close, flushes any pending number.  It does not close the underlying
+// io.Writer.  Calling Close more than once has no effect.
+func (w *Writer) Close() error {
+	if w.err == ErrClosed {
+		return nil
+	}
+	err := w.Flush()
+	if err == nil {
+		w.err = ErrClosed
+	}
+	return err
+}
+
+func (w *Writer) writeOut() error {
+	if _, err := w.n.WriteTo(w.w); err != nil {
+		w.err = err
+		return err
+	}
+	return nil
+}
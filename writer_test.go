@@ -0,0 +1,64 @@
+package num
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	fmt.Fprintf(w, "a %d b ", 1234567)
+	if got, want := buf.String(), "a 1,234,567 b "; got != want {
+		t.Errorf("Write: got %q want: %q", got, want)
+	}
+	// the trailing number may continue in the next write
+	fmt.Fprint(w, "1234")
+	if got, want := buf.String(), "a 1,234,567 b "; got != want {
+		t.Errorf("Write: got %q want: %q", got, want)
+	}
+	fmt.Fprint(w, "567")
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), "a 1,234,567 b 1,234,567"; got != want {
+		t.Errorf("Flush: got %q want: %q", got, want)
+	}
+	fmt.Fprint(w, " 7654321")
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := buf.String(), "a 1,234,567 b 1,234,567 7,654,321"; got != want {
+		t.Errorf("Close: got %q want: %q", got, want)
+	}
+	if err := w.Close(); err != nil {
+		t.Errorf("Close: got error %v on second call", err)
+	}
+	if _, err := w.Write([]byte("1")); err != ErrClosed {
+		t.Errorf("Write: got error %v want: %v", err, ErrClosed)
+	}
+}
+
+type errWriter struct {
+	err error
+}
+
+func (w *errWriter) Write(p []byte) (int, error) {
+	return 0, w.err
+}
+
+func TestWriterError(t *testing.T) {
+	errWrite := errors.New("write error")
+	w := NewWriter(&errWriter{errWrite})
+	if _, err := w.Write([]byte("1234567 ")); err != errWrite {
+		t.Errorf("Write: got error %v want: %v", err, errWrite)
+	}
+	if _, err := w.Write([]byte("x")); err != errWrite {
+		t.Errorf("Write: error is not sticky: got %v want: %v", err, errWrite)
+	}
+	if err := w.Close(); err != errWrite {
+		t.Errorf("Close: got error %v want: %v", err, errWrite)
+	}
+}